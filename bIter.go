@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+)
+
+// B+树迭代器，保存从根节点到叶节点的路径
+// path[0] 是根节点，path[len-1] 是当前所在的叶节点
+// 第一个叶节点的 idx 0 是哨兵空键，迭代器停在那里时表示“第一个键之前”
+// 读到损坏的页时迭代器停止，Valid 返回 false，错误通过 Err 取得
+// 路径上的节点在迭代器使用期间占用页缓存，用完之后调用 Close
+type BIter struct {
+	tree *BTree
+	path []BNode  // 从根到叶的节点
+	ptrs []uint64 // 每一层节点的页号
+	pos  []uint16 // 每一层节点中的索引
+	err  error
+}
+
+// 定位到小于等于 key 的最大键
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node, err := treeLoad(tree, ptr)
+		if err != nil {
+			iter.err = err
+			return iter
+		}
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.ptrs = append(iter.ptrs, ptr)
+		iter.pos = append(iter.pos, idx)
+		switch node.btype() {
+		case BNODE_LEAF:
+			ptr = 0
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			iter.err = fmt.Errorf("page %d: %w", ptr, checkNodeType(node))
+			return iter
+		}
+	}
+	return iter
+}
+
+// 定位到大于等于 key 的最小键
+func (tree *BTree) SeekGE(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if !iter.Valid() {
+		iter.Next() // 停在哨兵上，移动到第一个键
+	} else if cur, _ := iter.Deref(); bytes.Compare(cur, key) < 0 {
+		iter.Next()
+	}
+	return iter
+}
+
+// 迭代器是否指向一个有效的键值对
+func (iter *BIter) Valid() bool {
+	if iter.err != nil || len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return false // 越过最后一个键
+	}
+	return !iter.atSentinel()
+}
+
+// 是否停在哨兵空键上，即每一层的索引都为 0
+func (iter *BIter) atSentinel() bool {
+	for _, idx := range iter.pos {
+		if idx != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 迭代过程中读取页的错误，没有错误时返回 nil
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// 释放路径上的节点，之后 Valid 返回 false，重复调用没有影响
+func (iter *BIter) Close() {
+	for _, ptr := range iter.ptrs {
+		treeUnpin(iter.tree, ptr)
+	}
+	iter.path, iter.ptrs, iter.pos = nil, nil, nil
+}
+
+// 返回当前的键值对，引用的是页内存，调用者不能修改
+// 存放在溢出页中的值会被重新拼接成一份拷贝，读取溢出页失败时值为 nil，错误记录在 Err 中
+func (iter *BIter) Deref() ([]byte, []byte) {
+	last := len(iter.path) - 1
+	node, idx := iter.path[last], iter.pos[last]
+	if node.isOverflow(idx) {
+		val, err := overflowRead(iter.tree, node.getVal(idx))
+		if err != nil {
+			iter.err = err
+		}
+		return node.getKey(idx), val
+	}
+	return node.getKey(idx), node.getVal(idx)
+}
+
+// 移动到下一个键，越过最后一个键之后 Valid 返回 false
+func (iter *BIter) Next() {
+	if iter.err != nil || len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return // 已经在末尾
+	}
+	if !iterNext(iter, last) {
+		iter.pos[last] = iter.path[last].nkeys() // 标记为末尾
+	}
+}
+
+// 移动到上一个键，越过第一个键之后停在哨兵上
+func (iter *BIter) Prev() {
+	if iter.err != nil || len(iter.path) == 0 {
+		return
+	}
+	iterPrev(iter, len(iter.path)-1)
+}
+
+// 在 level 层向右移动一位，必要时向上层借位，再重新加载下层节点
+// 所有层都已在最右端或者读取失败时返回 false
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++
+	} else if level > 0 {
+		if !iterNext(iter, level-1) {
+			return false
+		}
+	} else {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		// 父节点移动后，子节点要换成新的最左端
+		ptr := iter.path[level].getPtr(iter.pos[level])
+		kid, err := treeLoad(iter.tree, ptr)
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		treeUnpin(iter.tree, iter.ptrs[level+1])
+		iter.path[level+1], iter.ptrs[level+1] = kid, ptr
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+// 在 level 层向左移动一位，必要时向上层借位，再重新加载下层节点
+// 所有层都已在最左端或者读取失败时返回 false
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]--
+	} else if level > 0 {
+		if !iterPrev(iter, level-1) {
+			return false
+		}
+	} else {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		// 父节点移动后，子节点要换成新的最右端
+		ptr := iter.path[level].getPtr(iter.pos[level])
+		kid, err := treeLoad(iter.tree, ptr)
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		treeUnpin(iter.tree, iter.ptrs[level+1])
+		iter.path[level+1], iter.ptrs[level+1] = kid, ptr
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
+
+// 按顺序遍历 [start, end) 范围内的键值对，end 为 nil 表示不设上界
+// 产出的键值对引用的是页内存，需要保留时请自行拷贝
+// 读到损坏的页时遍历提前结束，需要区分时使用 RangeErr
+func (tree *BTree) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	seq, _ := tree.RangeErr(start, end)
+	return seq
+}
+
+// 与 Range 相同，另外返回一个函数，在遍历之后调用它取得读取页的错误
+// 遍历完整结束、调用者提前退出或者还没有遍历时错误为 nil
+//
+//	seq, errf := tree.RangeErr(start, end)
+//	for k, v := range seq { ... }
+//	if err := errf(); err != nil { ... }
+func (tree *BTree) RangeErr(start, end []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seq := func(yield func([]byte, []byte) bool) {
+		it := tree.SeekGE(start)
+		defer func() {
+			err = it.Err()
+			it.Close()
+		}()
+		for ; it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if it.Err() != nil || (end != nil && bytes.Compare(key, end) >= 0) {
+				return
+			}
+			if !yield(key, val) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// 插入 n 个键 key0000 ... 并返回按顺序排列的键
+func fillC(c *C, n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		c.add(key, fmt.Sprintf("val%04d", i))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestBIter(t *testing.T) {
+	t.Run("空树", func(t *testing.T) {
+		c := newC()
+		iter := c.tree.SeekGE([]byte("any"))
+		if iter.Valid() {
+			t.Error("空树的迭代器不应有效")
+		}
+		iter.Next()
+		iter.Prev()
+		if iter.Valid() {
+			t.Error("空树的迭代器不应有效")
+		}
+	})
+
+	t.Run("跨叶节点正向遍历", func(t *testing.T) {
+		c := newC()
+		keys := fillC(c, 2000)
+		if BNode(c.tree.get(c.tree.root)).btype() != BNODE_NODE {
+			t.Fatal("根节点应为内部节点")
+		}
+		var got []string
+		for iter := c.tree.SeekGE(nil); iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			if string(val) != c.ref[string(key)] {
+				t.Errorf("键 %q 的值不匹配: 得到 %q", key, val)
+			}
+			got = append(got, string(key))
+		}
+		if !slices.Equal(got, keys) {
+			t.Errorf("遍历结果错误: 得到 %d 个键", len(got))
+		}
+	})
+
+	t.Run("跨叶节点反向遍历", func(t *testing.T) {
+		c := newC()
+		keys := fillC(c, 2000)
+		var got []string
+		for iter := c.tree.SeekLE([]byte("zzz")); iter.Valid(); iter.Prev() {
+			key, _ := iter.Deref()
+			got = append(got, string(key))
+		}
+		slices.Reverse(got)
+		if !slices.Equal(got, keys) {
+			t.Errorf("反向遍历结果错误: 得到 %d 个键", len(got))
+		}
+	})
+
+	t.Run("Seek定位", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i += 2 {
+			c.add(fmt.Sprintf("key%04d", i), "v")
+		}
+		cases := []struct {
+			key    string
+			le, ge string // 空字符串表示无效
+		}{
+			{"key0100", "key0100", "key0100"},
+			{"key0101", "key0100", "key0102"},
+			{"a", "", "key0000"},
+			{"key0998", "key0998", "key0998"},
+			{"z", "key0998", ""},
+		}
+		for _, tc := range cases {
+			for _, mode := range []string{"le", "ge"} {
+				var iter *BIter
+				want := tc.le
+				if mode == "le" {
+					iter = c.tree.SeekLE([]byte(tc.key))
+				} else {
+					iter = c.tree.SeekGE([]byte(tc.key))
+					want = tc.ge
+				}
+				if want == "" {
+					if iter.Valid() {
+						key, _ := iter.Deref()
+						t.Errorf("Seek%s(%q) 期望无效, 得到 %q", mode, tc.key, key)
+					}
+					continue
+				}
+				if !iter.Valid() {
+					t.Errorf("Seek%s(%q) 期望 %q, 得到无效", mode, tc.key, want)
+					continue
+				}
+				if key, _ := iter.Deref(); string(key) != want {
+					t.Errorf("Seek%s(%q) 期望 %q, 得到 %q", mode, tc.key, want, key)
+				}
+			}
+		}
+	})
+
+	t.Run("越界后回退", func(t *testing.T) {
+		c := newC()
+		fillC(c, 500)
+		iter := c.tree.SeekLE([]byte("key0499"))
+		iter.Next()
+		iter.Next()
+		if iter.Valid() {
+			t.Fatal("越过最后一个键后应无效")
+		}
+		iter.Prev()
+		if key, _ := iter.Deref(); !iter.Valid() || string(key) != "key0499" {
+			t.Errorf("回退后期望 key0499, 得到 %q", key)
+		}
+
+		iter = c.tree.SeekGE([]byte("key0000"))
+		iter.Prev()
+		iter.Prev()
+		if iter.Valid() {
+			t.Fatal("越过第一个键后应无效")
+		}
+		iter.Next()
+		if key, _ := iter.Deref(); !iter.Valid() || string(key) != "key0000" {
+			t.Errorf("前进后期望 key0000, 得到 %q", key)
+		}
+	})
+}
+
+func TestBTreeRange(t *testing.T) {
+	c := newC()
+	keys := fillC(c, 1500)
+
+	t.Run("区间", func(t *testing.T) {
+		var got []string
+		for k, v := range c.tree.Range([]byte("key0100"), []byte("key1200")) {
+			if string(v) != c.ref[string(k)] {
+				t.Errorf("键 %q 的值不匹配", k)
+			}
+			got = append(got, string(k))
+		}
+		if !slices.Equal(got, keys[100:1200]) {
+			t.Errorf("区间结果错误: 得到 %d 个键", len(got))
+		}
+	})
+
+	t.Run("无上界", func(t *testing.T) {
+		var got []string
+		for k := range c.tree.Range([]byte("key1400x"), nil) {
+			got = append(got, string(k))
+		}
+		if !slices.Equal(got, keys[1401:]) {
+			t.Errorf("无上界结果错误: 得到 %v", got)
+		}
+	})
+
+	t.Run("提前退出", func(t *testing.T) {
+		n := 0
+		seq, errf := c.tree.RangeErr(nil, nil)
+		if errf() != nil {
+			t.Error("遍历之前不应有错误")
+		}
+		for range seq {
+			n++
+			if n == 10 {
+				break
+			}
+		}
+		if n != 10 || errf() != nil {
+			t.Errorf("提前退出错误: 得到 %d %v", n, errf())
+		}
+	})
+
+	t.Run("空区间", func(t *testing.T) {
+		for k := range c.tree.Range([]byte("key0500"), []byte("key0500")) {
+			t.Errorf("空区间不应产出键: %q", k)
+		}
+	})
+}
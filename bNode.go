@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
 // | type | nkeys |  pointers  |  offsets   | key-values | unused |
@@ -15,6 +16,17 @@ import (
 // |   2  |   2   | nil nil  |  8 19   | 2 2 "k1" "hi"  2 5 "k3" "hello" |        |
 // |  2B  |  2B   |   2×8B   |  2×2B   | 4B + 2B + 2B + 4B + 2B + 5B     |        |
 
+// 前缀压缩的格式在 nkeys 之后保存所有键的共同前缀，每个键值对只保存键的后缀：
+// | type | nkeys | plen | prefix | pointers | offsets | key-values | unused |
+// |  2B  |   2B  |  2B  |  plen  |    ...   |   ...   |     ...    |        |
+// type 的 BNODE_PREFIX 位表示使用这种格式，klen 是后缀的长度。
+//
+// 共同前缀在分裂时按节点的键的范围确定：左边的节点取它的第一个键与右边节点第一个键的共同前缀，
+// 插入时最后一个节点取它的第一个键与父节点中下一个分隔键的共同前缀，
+// 以后插入这个节点的键都落在这个范围内，前缀不需要缩短。
+// 删除会让分隔键变大，使左边的节点的范围扩大，范围外的键不再共享前缀，
+// 这时插入的键放到一个新的右兄弟节点中，见 treeInsert。
+
 // 一个B树的节点
 type BNode []byte
 
@@ -23,11 +35,51 @@ const (
 	BNODE_LEAF = 2 // leaf nodes with values
 )
 
+// type 的标志位，节点使用前缀压缩的格式
+const BNODE_PREFIX = 0x100
+
 const HEADER = 4
 
+// 默认的页大小，以及这个页大小下键值对的上限
 const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000 // 更大的值存放在溢出页中
+
+// 支持的最大页大小
+const BTREE_MAX_PAGE_SIZE = 64 << 10
+
+// 页大小必须是 4K 到 64K 之间的 2 的幂
+func checkPageSize(size int) error {
+	if size < BTREE_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d", size)
+	}
+	return nil
+}
+
+// 节点最多使用的字节数
+// 偏移量是 uint16，临时超出的节点（满节点加上一个最大的键值对）也必须能表示，
+// 所以 64K 的页中节点只使用前 48K，剩下的空间只有溢出页会用到
+func nodeSizeOf(pageSize int) int {
+	return min(pageSize, 48<<10)
+}
+
+// 键的上限随页大小按比例增大，16K 以上不再增大，理由同上
+// 页头保存校验和时可用的页大小比 2 的幂略小，按向上取整的 4K 倍数计算
+func maxKeySizeOf(pageSize int) int {
+	return pageUnits(pageSize) * BTREE_MAX_KEY_SIZE
+}
+
+// 节点中内联保存的值的上限，更大的值存放在溢出页中
+func maxValSizeOf(pageSize int) int {
+	return pageUnits(pageSize) * BTREE_MAX_VAL_SIZE
+}
+
+func pageUnits(pageSize int) int {
+	return (min(pageSize, 16<<10) + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE
+}
+
+// vlen 的最高位表示值存放在溢出页中，节点中只保存引用
+const VAL_OVERFLOW = 0x8000
 
 // func init() {
 // 	node1max := 4 + 1*8 + 1*2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
@@ -36,7 +88,29 @@ const BTREE_MAX_VAL_SIZE = 3000
 
 // 获得节点的类型
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
+}
+
+// 节点是否使用前缀压缩的格式
+func (node BNode) prefixed() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0
+}
+
+// 节点的共同前缀，不使用前缀压缩时返回 nil，使用时即使前缀为空也不是 nil
+func (node BNode) prefix() []byte {
+	if !node.prefixed() {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node[HEADER:])
+	return node[HEADER+2:][:plen:plen]
+}
+
+// 头部的大小，包括共同前缀
+func (node BNode) hsize() uint16 {
+	if !node.prefixed() {
+		return HEADER
+	}
+	return HEADER + 2 + binary.LittleEndian.Uint16(node[HEADER:])
 }
 
 // 获取节点的类型
@@ -50,19 +124,31 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node[2:4], nkeys)
 }
 
+// 设置头部和共同前缀，prefix 为 nil 表示不使用前缀压缩
+// 之后添加的键都必须以 prefix 开头
+func (node BNode) setHeaderPrefix(btype uint16, nkeys uint16, prefix []byte) {
+	if prefix == nil {
+		node.setHeader(btype, nkeys)
+		return
+	}
+	node.setHeader(btype|BNODE_PREFIX, nkeys)
+	binary.LittleEndian.PutUint16(node[HEADER:], uint16(len(prefix)))
+	copy(node[HEADER+2:], prefix)
+}
+
 // idx 是键的索引
 // 得到索引之后的键
 // 读取和写入指针数组（用于内部节点）
 func (node BNode) getPtr(idx uint16) uint64 {
 	// assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.hsize() + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 // 设置索引之后的键
 func (node BNode) setPtr(idx uint16, val uint64) {
 	// assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.hsize() + 8*idx
 	binary.LittleEndian.PutUint64(node[pos:], val)
 }
 
@@ -71,7 +157,7 @@ func (node BNode) getOffset(idx uint16) uint16 {
 	if idx == 0 {
 		return 0
 	}
-	pos := HEADER + 8*node.nkeys() + 2*(idx-1)
+	pos := node.hsize() + 8*node.nkeys() + 2*(idx-1)
 	return binary.LittleEndian.Uint16(node[pos:])
 }
 
@@ -80,7 +166,7 @@ func (node BNode) setOffset(idx uint16, val uint16) {
 	if idx == 0 {
 		return
 	}
-	pos := HEADER + 8*node.nkeys() + 2*(idx-1)
+	pos := node.hsize() + 8*node.nkeys() + 2*(idx-1)
 	//取两个字节的偏移量
 	binary.LittleEndian.PutUint16(node[pos:], val)
 }
@@ -88,26 +174,52 @@ func (node BNode) setOffset(idx uint16, val uint16) {
 // 得到索引之后的键值对位置
 func (node BNode) kvPos(idx uint16) uint16 {
 	//assert(idx <= node.nkeys())
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.hsize() + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
 }
 
 // 以 slice 形式获取第 n 个 key 数据。
+// 使用前缀压缩时返回拼接出来的新 slice
 func (node BNode) getKey(idx uint16) []byte {
 	//assert(idx < node.nkeys())
+	prefix := node.prefix()
+	if prefix == nil {
+		return node.rawKey(idx)
+	}
+	suffix := node.rawKey(idx)
+	key := make([]byte, 0, len(prefix)+len(suffix))
+	return append(append(key, prefix...), suffix...)
+}
+
+// 节点中保存的第 n 个键，使用前缀压缩时是去掉共同前缀的后缀
+func (node BNode) rawKey(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
 	return node[pos+4:][:klen]
 }
 
 // 以 slice 形式获取第 n 个 key-value 数据。
+// 值存放在溢出页中时，得到的是指向溢出页的引用
 func (node BNode) getVal(idx uint16) []byte {
 	// assert(idx < node.nkeys()
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) &^ VAL_OVERFLOW
 	return node[pos+4+klen:][:vlen]
 }
 
+// 第 n 个值是否存放在溢出页中
+func (node BNode) isOverflow(idx uint16) bool {
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos+2:])&VAL_OVERFLOW != 0
+}
+
+// 标记第 n 个值存放在溢出页中
+func (node BNode) setOverflow(idx uint16) {
+	pos := node.kvPos(idx)
+	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	binary.LittleEndian.PutUint16(node[pos+2:], vlen|VAL_OVERFLOW)
+}
+
 // node的大小
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
@@ -115,6 +227,12 @@ func (node BNode) nbytes() uint16 {
 
 // node添加键值对
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	if prefix := new.prefix(); len(prefix) > 0 {
+		if !bytes.HasPrefix(key, prefix) {
+			panic("nodeAppendKV: key without the node prefix")
+		}
+		key = key[len(prefix):]
+	}
 	// ptrs
 	new.setPtr(idx, ptr)
 	// KVs
@@ -133,22 +251,29 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 // dstNew 是新节点的索引位置
 // srcOld 是旧节点的索引位置
 func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
+	prefix := old.prefix()
+	var key []byte // 拼接完整的键，避免每个键都分配一次
 	for i := uint16(0); i < n; i++ {
 		dst, src := dstNew+i, srcOld+i
-		nodeAppendKV(new, dst, old.getPtr(src), old.getKey(src), old.getVal(src))
+		key = append(append(key[:0], prefix...), old.rawKey(src)...)
+		nodeAppendKV(new, dst, old.getPtr(src), key, old.getVal(src))
+		if old.isOverflow(src) {
+			new.setOverflow(dst)
+		}
 	}
 
 }
 
+// 以下几个函数生成的节点使用 old 的格式和前缀，新的键必须共享这个前缀
 func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nkeys()+1)
+	new.setHeaderPrefix(BNODE_LEAF, old.nkeys()+1, old.prefix())
 	nodeAppendRange(new, old, 0, 0, idx)                   //添加idx的键值对之前的所有键值对 [0,idx)
 	nodeAppendKV(new, idx, 0, key, val)                    //将新键值对添加到新节点中，new
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx) //添加idx之后的所有键值对 [idx,nkeys)
 }
 
 func leafUpdata(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nkeys())
+	new.setHeaderPrefix(BNODE_LEAF, old.nkeys(), old.prefix())
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-idx-1)
@@ -156,7 +281,7 @@ func leafUpdata(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 
 // 从leafNode 移除key
 func leafDelete(new BNode, old BNode, idx uint16) {
-	new.setHeader(BNODE_LEAF, old.nkeys()-1)
+	new.setHeaderPrefix(BNODE_LEAF, old.nkeys()-1, old.prefix())
 	// 1. 复制删除位置之前的所有键值对
 	nodeAppendRange(new, old, 0, 0, idx)
 	// 2. 跳过要删除的键值对(idx位置)
@@ -165,86 +290,144 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 }
 
 // nodeLookupLE 查找小于等于给定键的最大索引
+// 第 0 个键总是小于等于给定的键，在 [1, nkeys) 上按偏移量表二分查找
+// 使用前缀压缩时先比较共同前缀，再直接与节点中的后缀比较
 func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	found := uint16(0)
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
+	prefix := node.prefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			return 0 // 比所有键都小
 		}
-		if cmp >= 0 {
-			break
+		return node.nkeys() - 1 // 比所有键都大
+	}
+	key = key[len(prefix):]
+	// 找到第一个大于 key 的位置，它的前一个就是结果
+	lo, hi := uint16(1), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if bytes.Compare(node.rawKey(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1
 }
 
-// 将节点分裂为两个节点
-func nodeSplit2(left BNode, right BNode, old BNode) {
+// 将节点分裂为两个节点，右边的节点不超过 pageSize 对应的节点大小
+// 使用前缀压缩时，右边的节点沿用 old 的前缀（由 splitKids 按上界延长），
+// 左边的节点的范围到右边节点的第一个键为止，
+// 前缀取这两个键的共同前缀，不会比 old 的前缀短，所以按 old 的格式估计的大小是上界
+func nodeSplit2(left BNode, right BNode, old BNode, pageSize int) {
+	limit := nodeSizeOf(pageSize)
 	nleft := old.nkeys() / 2
+	hsize := int(old.hsize())
 
-	left_bytes := func() uint16 {
-		return 4 + 8*nleft + 2*nleft + old.getOffset(nleft)
+	left_bytes := func() int {
+		return hsize + 8*int(nleft) + 2*int(nleft) + int(old.getOffset(nleft))
 	}
 
-	for left_bytes() > BTREE_PAGE_SIZE {
+	for left_bytes() > limit {
 		nleft--
 	}
 
-	right_bytes := func() uint16 {
-		return old.nbytes() - left_bytes() + 4
+	right_bytes := func() int {
+		return int(old.nbytes()) - left_bytes() + hsize
 	}
 
-	for right_bytes() > BTREE_PAGE_SIZE {
+	for right_bytes() > limit {
 		nleft++
 	}
 
 	nright := old.nkeys() - nleft
 	//new nodes
-	left.setHeader(old.btype(), nleft)
-	right.setHeader(old.btype(), nright)
+	var leftPrefix []byte
+	if old.prefix() != nil {
+		leftPrefix = commonPrefix(old.getKey(0), old.getKey(nleft))
+	}
+	left.setHeaderPrefix(old.btype(), nleft, leftPrefix)
+	right.setHeaderPrefix(old.btype(), nright, old.prefix())
 	nodeAppendRange(left, old, 0, 0, nleft)
 	nodeAppendRange(right, old, 0, nleft, nright)
 }
 
 // nodeSplit3 将节点分裂为三个节点，如果节点很大
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+// 返回的节点都是 pageSize 大小的页
+func nodeSplit3(old BNode, pageSize int) (uint16, [3]BNode) {
+	limit := nodeSizeOf(pageSize)
+	if int(old.nbytes()) <= limit {
+		old = old[:pageSize]
 		return 1, [3]BNode{old}
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) //可能还要分一次
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
+	left := BNode(make([]byte, 2*pageSize)) //可能还要分一次
+	right := BNode(make([]byte, pageSize))
 
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left := left[:BTREE_PAGE_SIZE]
+	nodeSplit2(left, right, old, pageSize)
+	if int(left.nbytes()) <= limit {
+		left := left[:pageSize]
 		return 2, [3]BNode{left, right}
 	}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	// assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
+	leftleft := BNode(make([]byte, pageSize))
+	middle := BNode(make([]byte, pageSize))
+	nodeSplit2(leftleft, middle, left, pageSize)
+	// assert(leftleft.nbytes() <= limit)
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
-// 合并两个节点成一个
+// 合并两个节点成一个，合并后的前缀是两个前缀的共同前缀
 func nodeMerge(new BNode, left BNode, right BNode) {
-	new.setHeader(BNODE_LEAF, left.nkeys()+right.nkeys())
+	new.setHeaderPrefix(left.btype(), left.nkeys()+right.nkeys(), mergedPrefix(left, right))
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
 
+// 以新的前缀复制节点，所有的键都必须以 prefix 开头
+func nodeReprefix(new BNode, old BNode, prefix []byte) {
+	new.setHeaderPrefix(old.btype(), old.nkeys(), prefix)
+	nodeAppendRange(new, old, 0, 0, old.nkeys())
+}
+
 // 用1替换2个相邻链接
 func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
 	// 设置新节点头部信息（类型和键数量）
-	new.setHeader(BNODE_NODE, old.nkeys()-1) // 减少一个键
+	new.setHeaderPrefix(BNODE_NODE, old.nkeys()-1, old.prefix()) // 减少一个键
 	// 1. 复制idx之前的所有指针和键
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, ptr, key, nil) // 添加分隔键（内部节点val为nil）
 	// 3. 跳过被替换的两个指针和一个键，复制剩余部分
 	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
+
+// 两个键的共同前缀，a 为 nil 时返回 nil
+func commonPrefix(a []byte, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n:n]
+}
+
+// 合并两个节点后的前缀，都不使用前缀压缩时为 nil
+func mergedPrefix(left BNode, right BNode) []byte {
+	lp, rp := left.prefix(), right.prefix()
+	if lp == nil || rp == nil {
+		return nil
+	}
+	return commonPrefix(lp, rp)
+}
+
+// 合并两个节点之后的大小，前缀变短时每个键的后缀都会变长
+func nodeMergedSize(left BNode, right BNode) int {
+	plen := len(mergedPrefix(left, right))
+	size := HEADER
+	if left.prefix() != nil && right.prefix() != nil {
+		size += 2 + plen
+	}
+	for _, node := range []BNode{left, right} {
+		grow := len(node.prefix()) - plen
+		size += int(node.nbytes()) - int(node.hsize()) + int(node.nkeys())*grow
+	}
+	return size
+}
@@ -639,7 +639,7 @@ func TestNodeSplit2(t *testing.T) {
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
 
 		// 执行分裂
-		nodeSplit2(left, right, old)
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
 
 		// 验证左节点
 		if left.nkeys() != 2 {
@@ -666,7 +666,7 @@ func TestNodeSplit2(t *testing.T) {
 
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeSplit2(left, right, old)
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
 
 		// 验证分裂结果
 		if left.nkeys()+right.nkeys() != old.nkeys() {
@@ -688,7 +688,7 @@ func TestNodeSplit2(t *testing.T) {
 
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeSplit2(left, right, old)
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
 
 		// 验证分裂后的节点大小不超过页大小
 		if left.nbytes() > BTREE_PAGE_SIZE {
@@ -718,7 +718,7 @@ func TestNodeSplit2(t *testing.T) {
 
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeSplit2(left, right, old)
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
 
 		// 验证分裂后的节点大小不超过页大小
 		if left.nbytes() > BTREE_PAGE_SIZE {
@@ -746,7 +746,7 @@ func TestNodeSplit2(t *testing.T) {
 
 		left := BNode(make([]byte, BTREE_PAGE_SIZE))
 		right := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeSplit2(left, right, old)
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
 
 		// 验证节点类型保持不变
 		if left.btype() != BNODE_NODE || right.btype() != BNODE_NODE {
@@ -767,7 +767,7 @@ func TestNodeSplit3(t *testing.T) {
 		old.setHeader(BNODE_LEAF, 1)
 		nodeAppendKV(old, 0, 0, []byte("key"), []byte("val"))
 
-		count, nodes := nodeSplit3(old)
+		count, nodes := nodeSplit3(old, BTREE_PAGE_SIZE)
 		if count != 1 {
 			t.Errorf("期望不分裂(1个节点), 得到 %d 个节点", count)
 		}
@@ -786,7 +786,7 @@ func TestNodeSplit3(t *testing.T) {
 			nodeAppendKV(old, uint16(i), 0, []byte(key), []byte(val))
 		}
 
-		count, nodes := nodeSplit3(old)
+		count, nodes := nodeSplit3(old, BTREE_PAGE_SIZE)
 		if count != 2 {
 			t.Errorf("期望分裂为2个节点, 得到 %d 个节点", count)
 		}
@@ -812,7 +812,7 @@ func TestNodeSplit3(t *testing.T) {
 		}
 		fmt.Printf("old nbytes: %d\n", old.nbytes())
 
-		count, nodes := nodeSplit3(old)
+		count, nodes := nodeSplit3(old, BTREE_PAGE_SIZE)
 		if count != 3 {
 			t.Errorf("期望分裂为3个节点, 得到 %d 个节点", count)
 		}
@@ -1049,3 +1049,157 @@ func TestNodeReplace2Kid(t *testing.T) {
         testOffset(t, new, 2, expectedOffset2)
     })
 }
+
+// 线性扫描的 nodeLookupLE，作为二分查找的对照
+func nodeLookupLELinear(node BNode, key []byte) uint16 {
+	found := uint16(0)
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if bytes.Compare(node.getKey(i), key) > 0 {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+// 创建一个包含 n 个有序键的叶节点，第 0 个键是哨兵空键
+func createLookupNode(n int) BNode {
+	node := BNode(make([]byte, 4*BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, uint16(n))
+	nodeAppendKV(node, 0, 0, nil, nil)
+	for i := 1; i < n; i++ {
+		nodeAppendKV(node, uint16(i), 0, []byte(fmt.Sprintf("key%04d", 2*i)), []byte("v"))
+	}
+	return node
+}
+
+func TestNodeLookupLEMatchesLinear(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 10, 100, 400} {
+		node := createLookupNode(n)
+		for i := 0; i < 2*n+2; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if got, want := nodeLookupLE(node, key), nodeLookupLELinear(node, key); got != want {
+				t.Errorf("%d 个键, 查找 %q: 期望 %d, 得到 %d", n, key, want, got)
+			}
+		}
+		for _, key := range []string{"", "a", "key", "z"} {
+			if got, want := nodeLookupLE(node, []byte(key)), nodeLookupLELinear(node, []byte(key)); got != want {
+				t.Errorf("%d 个键, 查找 %q: 期望 %d, 得到 %d", n, key, want, got)
+			}
+		}
+	}
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	for _, n := range []int{10, 100, 400} {
+		node := createLookupNode(n)
+		keys := make([][]byte, 64)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key%04d", rand.Intn(2*n)))
+		}
+		b.Run(fmt.Sprintf("binary/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nodeLookupLE(node, keys[i%len(keys)])
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nodeLookupLELinear(node, keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func TestNodePrefix(t *testing.T) {
+	// 使用前缀压缩的叶节点，值是 "v" 加上键
+	newPrefixLeaf := func(prefix string, keys ...string) BNode {
+		node := BNode(make([]byte, BTREE_PAGE_SIZE))
+		node.setHeaderPrefix(BNODE_LEAF, uint16(len(keys)), []byte(prefix))
+		for i, key := range keys {
+			nodeAppendKV(node, uint16(i), 0, []byte(key), []byte("v"+key))
+		}
+		return node
+	}
+	var keys []string
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("user/%02d", i))
+	}
+
+	t.Run("只保存后缀", func(t *testing.T) {
+		node := newPrefixLeaf("user/", keys...)
+		plain := BNode(make([]byte, BTREE_PAGE_SIZE))
+		plain.setHeader(BNODE_LEAF, 10)
+		for i, key := range keys {
+			nodeAppendKV(plain, uint16(i), 0, []byte(key), []byte("v"+key))
+		}
+		if node.btype() != BNODE_LEAF || string(node.prefix()) != "user/" {
+			t.Fatalf("头部错误: %d %q", node.btype(), node.prefix())
+		}
+		for i, key := range keys {
+			testKV(t, node, uint16(i), []byte(key), []byte("v"+key))
+			if string(node.rawKey(uint16(i))) != key[len("user/"):] {
+				t.Errorf("应只保存后缀: %q", node.rawKey(uint16(i)))
+			}
+		}
+		// 每个键省下 5 字节，头部多出 2 字节的长度和 5 字节的前缀
+		if want := int(plain.nbytes()) - 10*5 + 2 + 5; int(node.nbytes()) != want {
+			t.Errorf("节点大小错误: 期望 %d, 得到 %d", want, node.nbytes())
+		}
+		if plain.prefix() != nil || newPrefixLeaf("").prefix() == nil {
+			t.Error("nil 表示不使用前缀压缩，空前缀仍使用这种格式")
+		}
+	})
+
+	t.Run("查找", func(t *testing.T) {
+		node := newPrefixLeaf("user/", keys...)
+		for _, tc := range []struct {
+			key string
+			idx uint16
+		}{{"user/00", 0}, {"user/05", 5}, {"user/055", 5}, {"user/99", 9}, {"user/", 0}, {"a", 0}, {"user", 0}, {"z", 9}, {"user0", 9}} {
+			if idx := nodeLookupLE(node, []byte(tc.key)); idx != tc.idx {
+				t.Errorf("查找 %q: 期望 %d, 得到 %d", tc.key, tc.idx, idx)
+			}
+		}
+	})
+
+	t.Run("分裂和合并", func(t *testing.T) {
+		old := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+		old.setHeaderPrefix(BNODE_LEAF, 150, []byte("k"))
+		for i := 0; i < 150; i++ {
+			nodeAppendKV(old, uint16(i), 0, []byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte("v"), 30))
+		}
+		left, right := BNode(make([]byte, BTREE_PAGE_SIZE)), BNode(make([]byte, BTREE_PAGE_SIZE))
+		nodeSplit2(left, right, old, BTREE_PAGE_SIZE)
+		// 左边的节点取第一个键与右边节点第一个键的共同前缀，右边的节点沿用原来的前缀
+		want := commonPrefix(old.getKey(0), right.getKey(0))
+		if !bytes.Equal(left.prefix(), want) || string(right.prefix()) != "k" {
+			t.Errorf("分裂后的前缀错误: %q %q", left.prefix(), right.prefix())
+		}
+		if int(left.nbytes()) > BTREE_PAGE_SIZE || int(right.nbytes()) > BTREE_PAGE_SIZE {
+			t.Fatalf("分裂后的节点过大: %d %d", left.nbytes(), right.nbytes())
+		}
+
+		merged := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+		size := nodeMergedSize(left, right)
+		nodeMerge(merged, left, right)
+		if string(merged.prefix()) != "k" || int(merged.nbytes()) != size {
+			t.Errorf("合并后: 前缀 %q, 大小 %d, 估计 %d", merged.prefix(), merged.nbytes(), size)
+		}
+		for i := uint16(0); i < 150; i++ {
+			if !bytes.Equal(merged.getKey(i), old.getKey(i)) {
+				t.Fatalf("合并后第 %d 个键错误: %q", i, merged.getKey(i))
+			}
+		}
+
+		// 与不使用前缀压缩的节点合并时使用普通的格式
+		plain := BNode(make([]byte, BTREE_PAGE_SIZE))
+		plain.setHeader(BNODE_LEAF, 1)
+		nodeAppendKV(plain, 0, 0, []byte("z"), nil)
+		merged = BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+		size = nodeMergedSize(right, plain)
+		nodeMerge(merged, right, plain)
+		if merged.prefix() != nil || int(merged.nbytes()) != size {
+			t.Errorf("合并后: 前缀 %q, 大小 %d, 估计 %d", merged.prefix(), merged.nbytes(), size)
+		}
+	})
+}
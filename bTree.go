@@ -2,49 +2,297 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyKey      = errors.New("empty key")       // 空键保留给哨兵
+	ErrKeyTooLarge   = errors.New("key too large")   // 超过页大小对应的键的上限
+	ErrValueTooLarge = errors.New("value too large") // 超过 BTREE_MAX_OVERFLOW_SIZE
+	ErrCorruptPage   = errors.New("corrupt page")    // 页的内容不合法
+	ErrTreeNotEmpty  = errors.New("tree not empty")  // 批量导入只能用于空树
+	ErrUnsorted      = errors.New("keys not sorted") // 批量导入的键必须严格递增
+	ErrChecksum      = fmt.Errorf("%w: checksum mismatch", ErrCorruptPage)
 )
 
 type BTree struct {
-	root uint64
-	get  func(uint64) []byte // read a page
-	new  func([]byte) uint64 //append a page
-	del  func(uint64)        // ignored in this chapter
+	root   uint64
+	size   int                 // 页大小，0 表示 BTREE_PAGE_SIZE
+	prefix bool                // 新建的根节点使用前缀压缩的格式，其他节点沿用原节点的格式
+	get    func(uint64) []byte // read a page
+	new    func([]byte) uint64 //append a page
+	del    func(uint64)        // deallocate a page
+	check  func(uint64) error  // 校验页的内容，nil 表示不校验
+	unpin  func(uint64)        // 用完 check 过的页之后调用，nil 表示不需要
+}
+
+// 页大小
+func (tree *BTree) pageSize() int {
+	if tree.size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.size
+}
+
+// 节点最多使用的字节数
+func (tree *BTree) nodeSize() int {
+	return nodeSizeOf(tree.pageSize())
+}
+
+// 新建的根节点的前缀，使用前缀压缩时是空前缀，否则是 nil
+func (tree *BTree) rootPrefix() []byte {
+	if tree.prefix {
+		return []byte{}
+	}
+	return nil
+}
+
+// 插入的模式
+const (
+	MODE_UPSERT      = 0 // 插入或更新
+	MODE_UPDATE_ONLY = 1 // 只更新已存在的键
+	MODE_INSERT_ONLY = 2 // 只插入新的键
+	MODE_CAS         = 3 // 当前值等于 Expect 时才写入，Expect 为 nil 表示键必须不存在
+)
+
+// 一次插入请求及其结果
+type UpdateReq struct {
+	// 输入
+	Key    []byte
+	Val    []byte
+	Mode   int
+	Expect []byte // MODE_CAS 期望的当前值
+	// 输出
+	Added   bool   // 插入了新的键
+	Updated bool   // 插入了新的键，或者修改了已有键的值
+	Old     []byte // 键已存在时，更新之前的值
 }
 
+// 一次删除请求及其结果
+type DeleteReq struct {
+	// 输入
+	Key []byte
+	// 输出
+	Old []byte // 被删除的值
+}
+
+// 插入或更新一个键值对
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	return tree.InsertEx(&UpdateReq{Key: key, Val: val, Mode: MODE_UPSERT})
+}
+
+// 当前值等于 expected 时写入 newVal，返回比较是否成功
+// expected 为 nil 表示期望键不存在，用于“不存在才创建”；期望空值时请传 []byte{}
+// 比较和写入在同一次从根到叶的下降中完成
+func (tree *BTree) CompareAndSwap(key []byte, expected []byte, newVal []byte) (bool, error) {
+	req := &UpdateReq{Key: key, Val: newVal, Mode: MODE_CAS, Expect: expected}
+	if err := tree.InsertEx(req); err != nil {
+		return false, err
+	}
+	return casMatched(req), nil
+}
+
+// CAS 的比较是否成功；新值与当前值相同时不需要写入，但比较仍然成功
+func casMatched(req *UpdateReq) bool {
+	if req.Updated {
+		return true
+	}
+	return req.Old != nil && req.Expect != nil && bytes.Equal(req.Old, req.Expect)
+}
+
+// 按 req.Mode 插入或更新一个键值对，结果写回 req
 // 如果树为空，则创立根节点
 // 如果根节点分裂，则创建新根
-func (tree *BTree) Insert(key []byte, val []byte) {
+// 模式拒绝写入或者值没有变化时，不会复制任何节点
+func (tree *BTree) InsertEx(req *UpdateReq) error {
+	if err := checkKV(tree, req.Key, req.Val); err != nil {
+		return err
+	}
 	if tree.root == 0 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_LEAF, 2)
+		if !modeAllows(req, false) {
+			return nil
+		}
+		root := BNode(make([]byte, tree.pageSize()))
+		root.setHeaderPrefix(BNODE_LEAF, 2, tree.rootPrefix())
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		val, overflow := leafStoreVal(tree, req.Val)
+		nodeAppendKV(root, 1, 0, req.Key, val)
+		if overflow {
+			root.setOverflow(1)
+		}
 		tree.root = tree.new(root)
-		return
+		req.Added, req.Updated = true, true
+		return nil
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
+	node, err := treeLoad(tree, tree.root)
+	if err != nil {
+		return err
+	}
+	defer treeUnpin(tree, tree.root)
+	kids, err := treeInsert(tree, node, req, nil)
+	if err != nil || len(kids) == 0 {
+		return err // 出错或者没有修改
+	}
 	tree.del(tree.root)
-	if nsplit > 1 {
-		// 这个根节点需要分离，添加新的一层
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_NODE, nsplit)
-		for i, knode := range split[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+	treeSetRoot(tree, kids)
+	return nil
+}
+
+// 用修改后的节点作为新的根节点，节点已经分离成多个时添加新的一层
+func treeSetRoot(tree *BTree, kids []BNode) {
+	if len(kids) == 1 {
+		tree.root = tree.new(kids[0])
+		return
+	}
+	root := BNode(make([]byte, tree.pageSize()))
+	nodeLinkKids(tree, root, kids[0].prefix()[:0], kids)
+	tree.root = tree.new(root)
+}
+
+// 新建一个链接到 kids 的内部节点
+func nodeLinkKids(tree *BTree, new BNode, prefix []byte, kids []BNode) {
+	new.setHeaderPrefix(BNODE_NODE, uint16(len(kids)), prefix)
+	for i, kid := range kids {
+		nodeAppendKV(new, uint16(i), tree.new(kid), kid.getKey(0), nil)
+	}
+}
+
+// 把修改后的节点按页大小分离，sibling 不为空时是跟在后面的新节点
+// upper 是这些节点中的键的上界，nil 表示没有上界
+func splitKids(tree *BTree, new BNode, sibling BNode, upper []byte) []BNode {
+	nsplit, split := nodeSplit3(new, tree.pageSize())
+	kids := split[:nsplit]
+	if len(sibling) > 0 {
+		return append(kids, sibling)
+	}
+	// 分离出的左边的节点的前缀已经延伸到右边节点的第一个键，
+	// 最后一个节点同样可以延伸到与上界的共同前缀
+	last := kids[nsplit-1]
+	if upper != nil && last.prefix() != nil {
+		if prefix := commonPrefix(last.getKey(0), upper); len(prefix) > len(last.prefix()) {
+			kids[nsplit-1] = BNode(make([]byte, tree.pageSize()))
+			nodeReprefix(kids[nsplit-1], last, prefix)
 		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(split[0])
 	}
+	return kids
+}
+
+// 按 req.Mode 判断是否可以写入，exists 表示键已存在，此时 req.Old 是当前值
+func modeAllows(req *UpdateReq, exists bool) bool {
+	switch req.Mode {
+	case MODE_UPDATE_ONLY:
+		return exists
+	case MODE_INSERT_ONLY:
+		return !exists
+	case MODE_CAS:
+		if !exists {
+			return req.Expect == nil
+		}
+		return req.Expect != nil && bytes.Equal(req.Old, req.Expect)
+	default:
+		return true
+	}
+}
+
+// 准备写入叶节点的值
+// 超过节点中值的上限的值写入溢出页，叶节点中只保存引用
+func leafStoreVal(tree *BTree, val []byte) ([]byte, bool) {
+	if len(val) <= maxValSizeOf(tree.pageSize()) {
+		return val, false
+	}
+	return overflowWrite(tree, val), true
+}
+
+// 读取叶节点中的值的拷贝，存放在溢出页中的值会被拼接起来
+func leafGetVal(tree *BTree, node BNode, idx uint16) ([]byte, error) {
+	if node.isOverflow(idx) {
+		return overflowRead(tree, node.getVal(idx))
+	}
+	return append([]byte{}, node.getVal(idx)...), nil
+}
+
+// 检查键值对的大小，避免写入时 uint16 的长度和偏移量溢出
+func checkKV(tree *BTree, key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if limit := maxKeySizeOf(tree.pageSize()); len(key) > limit {
+		return fmt.Errorf("%w: %d > %d", ErrKeyTooLarge, len(key), limit)
+	}
+	if len(val) > BTREE_MAX_OVERFLOW_SIZE {
+		return fmt.Errorf("%w: %d > %d", ErrValueTooLarge, len(val), BTREE_MAX_OVERFLOW_SIZE)
+	}
+	return nil
+}
+
+// 读取一页，设置了 tree.check 时先校验，错误中带有页号
+func treePage(tree *BTree, ptr uint64) ([]byte, error) {
+	if tree.check != nil {
+		if err := tree.check(ptr); err != nil {
+			return nil, fmt.Errorf("page %d: %w", ptr, err)
+		}
+	}
+	return tree.get(ptr), nil
+}
+
+// 读取一个节点并检查节点类型
+func treeLoad(tree *BTree, ptr uint64) (BNode, error) {
+	page, err := treePage(tree, ptr)
+	if err != nil {
+		return nil, err
+	}
+	node := BNode(page)
+	if err := checkNodeType(node); err != nil {
+		treeUnpin(tree, ptr)
+		return nil, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	return node, nil
 }
 
+// 用完 treePage 或 treeLoad 读取的页之后释放，使用页缓存时页在此之前不会被淘汰
+func treeUnpin(tree *BTree, ptr uint64) {
+	if tree.unpin != nil {
+		tree.unpin(ptr)
+	}
+}
+
+func checkNodeType(node BNode) error {
+	if len(node) < HEADER {
+		return fmt.Errorf("%w: truncated node", ErrCorruptPage)
+	}
+	if t := node.btype(); t != BNODE_LEAF && t != BNODE_NODE {
+		return fmt.Errorf("%w: bad node type %d", ErrCorruptPage, t)
+	}
+	if node.prefixed() && (len(node) < HEADER+2 || int(node.hsize()) > len(node)) {
+		return fmt.Errorf("%w: bad prefix length", ErrCorruptPage)
+	}
+	return nil
+}
+
+// 删除一个键，返回是否找到
 func (tree *BTree) Delete(key []byte) (bool, error) {
+	return tree.DeleteEx(&DeleteReq{Key: key})
+}
+
+// 删除一个键，被删除的值写回 req.Old
+func (tree *BTree) DeleteEx(req *DeleteReq) (bool, error) {
+	if len(req.Key) == 0 {
+		return false, ErrEmptyKey
+	}
 	if tree.root == 0 {
 		return false, nil //空节点
 	}
-	updated := treeDelete(tree, tree.get(tree.root), key)
+	node, err := treeLoad(tree, tree.root)
+	if err != nil {
+		return false, err
+	}
+	defer treeUnpin(tree, tree.root)
+	updated, err := treeDelete(tree, node, req)
+	if err != nil {
+		return false, err
+	}
 	if len(updated) == 0 {
 		return false, nil // key 没有找到
 	}
@@ -67,24 +315,105 @@ func (tree *BTree) Delete(key []byte) (bool, error) {
 	return true, nil
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
-	//额外的尺寸允许其暂时超过1页。
-	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	idx := nodeLookupLE(node, key) //寻找索引
+// 点查询，返回值的拷贝，调用者不会引用到 tree.get 返回的页内存
+// 空 key 是创建根节点时插入的哨兵，不对外可见
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	if tree.root == 0 || len(key) == 0 {
+		return nil, false, nil
+	}
+	node, err := treeLoad(tree, tree.root)
+	if err != nil {
+		return nil, false, err
+	}
+	defer treeUnpin(tree, tree.root)
+	return treeGet(tree, node, key)
+}
+
+// 从 node 开始递归查找 key
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
+	idx := nodeLookupLE(node, key)
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdata(new, node, idx, key, val) //发现，更新它
-		} else {
-			leafInsert(new, node, idx+1, key, val) //没有发现，插入
+		if !bytes.Equal(key, node.getKey(idx)) {
+			return nil, false, nil
 		}
+		val, err := leafGetVal(tree, node, idx)
+		if err != nil {
+			return nil, false, err
+		}
+		return val, true, nil
+	case BNODE_NODE:
+		ptr := node.getPtr(idx)
+		kid, err := treeLoad(tree, ptr)
+		if err != nil {
+			return nil, false, err
+		}
+		defer treeUnpin(tree, ptr)
+		return treeGet(tree, kid, key)
+	default:
+		// 经过 treeLoad 读取的节点已经检查过类型，错误中带有页号
+		return nil, false, checkNodeType(node)
+	}
+}
+
+// 返回修改后按页大小分离好的节点，返回空表示没有修改
+// upper 是 node 中的键的上界，nil 表示没有上界
+func treeInsert(tree *BTree, node BNode, req *UpdateReq, upper []byte) ([]BNode, error) {
+	idx := nodeLookupLE(node, req.Key) //寻找索引
+	switch node.btype() {
+	case BNODE_LEAF:
+		exists := bytes.Equal(req.Key, node.getKey(idx))
+		if exists {
+			old, err := leafGetVal(tree, node, idx)
+			if err != nil {
+				return nil, err
+			}
+			req.Old = old
+		}
+		// 模式拒绝写入，或者值没有变化
+		if !modeAllows(req, exists) || (exists && bytes.Equal(req.Old, req.Val)) {
+			return nil, nil
+		}
+		val, overflow := leafStoreVal(tree, req.Val)
+		//额外的尺寸允许其暂时超过1页。
+		new := BNode(make([]byte, 2*tree.pageSize()))
+		var sibling BNode
+		switch {
+		case exists:
+			if node.isOverflow(idx) {
+				//释放旧值的溢出页
+				if err := overflowFree(tree, node.getVal(idx)); err != nil {
+					return nil, err
+				}
+			}
+			leafUpdata(new, node, idx, req.Key, val) //发现，更新它
+		case bytes.HasPrefix(req.Key, node.prefix()):
+			idx++
+			leafInsert(new, node, idx, req.Key, val) //没有发现，插入
+		default:
+			// 键不共享节点的前缀，只可能大于所有的键，
+			// 节点保持不变，新的键单独放到右兄弟节点中
+			copy(new, node)
+			sibling = BNode(make([]byte, tree.pageSize()))
+			sibling.setHeaderPrefix(BNODE_LEAF, 1, node.prefix()[:0])
+			nodeAppendKV(sibling, 0, 0, req.Key, val)
+			if overflow {
+				sibling.setOverflow(0)
+			}
+			overflow = false
+		}
+		if overflow {
+			new.setOverflow(idx)
+		}
+		req.Added = !exists
+		req.Updated = true
+		return splitKids(tree, new, sibling, upper), nil
 	case BNODE_NODE:
 		//internal node,插入子节点
-		nodeInsert(tree, new, node, idx, key, val)
+		return nodeInsert(tree, node, idx, req, upper)
 	default:
-		panic("bad node!")
+		return nil, checkNodeType(node)
 	}
-	return new
 }
 
 // 将一个链接替换为多个链接
@@ -94,7 +423,7 @@ func nodeReplaceKidN(
 	kids ...BNode,
 ) {
 	inc := uint16(len(kids))
-	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
+	new.setHeaderPrefix(BNODE_NODE, old.nkeys()+inc-1, old.prefix())
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
 		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
@@ -102,45 +431,65 @@ func nodeReplaceKidN(
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
-	idx := nodeLookupLE(node, key)
+func treeDelete(tree *BTree, node BNode, req *DeleteReq) (BNode, error) {
+	idx := nodeLookupLE(node, req.Key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{}
+		if !bytes.Equal(req.Key, node.getKey(idx)) {
+			return BNode{}, nil
+		}
+		old, err := leafGetVal(tree, node, idx) // 在释放溢出页之前读取
+		if err != nil {
+			return BNode{}, err
 		}
-		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		req.Old = old
+		if node.isOverflow(idx) {
+			if err := overflowFree(tree, node.getVal(idx)); err != nil {
+				return BNode{}, err
+			}
+		}
+		new := BNode(make([]byte, tree.pageSize()))
 		leafDelete(new, node, idx)
-		return new
+		return new, nil
 	case BNODE_NODE:
-		return nodeDelete(tree, node, idx, key)
+		return nodeDelete(tree, node, idx, req)
 	default:
-		panic("treeDelete: bad node!")
+		return BNode{}, checkNodeType(node)
 	}
 }
 
 // 删除一个key从一个internal node；treeDelete的一部分
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, req *DeleteReq) (BNode, error) {
 	//递归去子节点
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kptr), key)
-	if len(updated) == 0 {
-		return BNode{} // 没有发现
+	knode, err := treeLoad(tree, kptr)
+	if err != nil {
+		return BNode{}, err
+	}
+	defer treeUnpin(tree, kptr)
+	updated, err := treeDelete(tree, knode, req)
+	if err != nil || len(updated) == 0 {
+		return BNode{}, err // 没有发现
 	}
-	tree.del(kptr)
 	//检查合并
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
-	mergeDir, sibing := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibing, err := shouldMerge(tree, node, idx, updated)
+	if err != nil {
+		return BNode{}, err
+	}
+	tree.del(kptr)
+	new := BNode(make([]byte, tree.pageSize()))
 	switch {
 	case mergeDir < 0: //left
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := BNode(make([]byte, tree.pageSize()))
 		nodeMerge(merged, sibing, updated)
+		treeUnpin(tree, node.getPtr(idx-1))
 		tree.del(node.getPtr((idx - 1)))
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: //right
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := BNode(make([]byte, tree.pageSize()))
 		nodeMerge(merged, updated, sibing)
+		treeUnpin(tree, node.getPtr(idx+1))
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0 && updated.nkeys() == 0:
@@ -149,40 +498,314 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	case mergeDir == 0 && updated.nkeys() > 0:
 		nodeReplaceKidN(tree, new, node, idx, updated)
 	}
-	return new
+	return new, nil
+}
+
+// 删除 [start, end) 范围内的所有键，end 为 nil 表示不设上界，返回删除的键数
+// 完全落在范围内的子树整棵释放，只有两端的节点需要重写，整个过程只下降一次
+func (tree *BTree) DeleteRange(start, end []byte) (int, error) {
+	if tree.root == 0 || (end != nil && bytes.Compare(start, end) >= 0) {
+		return 0, nil
+	}
+	node, err := treeLoad(tree, tree.root)
+	if err != nil {
+		return 0, err
+	}
+	defer treeUnpin(tree, tree.root)
+	updated, count, err := treeDeleteRange(tree, node, start, end, nil)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	tree.del(tree.root)
+	if updated.nkeys() == 0 {
+		tree.root = 0
+		return count, nil
+	}
+	if updated.btype() == BNODE_LEAF || updated.nkeys() > 1 {
+		treeSetRoot(tree, splitKids(tree, updated, nil, nil))
+		return count, nil
+	}
+	// 只剩一个子节点的内部节点逐层提升为根节点
+	ptr := updated.getPtr(0)
+	for {
+		kid, err := treeLoad(tree, ptr)
+		if err != nil {
+			return 0, err
+		}
+		promote := kid.btype() == BNODE_NODE && kid.nkeys() == 1
+		next := kid.getPtr(0)
+		treeUnpin(tree, ptr)
+		if !promote {
+			break
+		}
+		tree.del(ptr)
+		ptr = next
+	}
+	tree.root = ptr
+	return count, nil
+}
+
+// 从 node 中删除 [start, end) 范围内的键，upper 是 node 中键的上界，nil 表示没有上界
+// 返回修改后的节点和删除的键数，没有删除任何键时返回空节点
+// 修改后的节点可能超过一页，由上层分离
+func treeDeleteRange(tree *BTree, node BNode, start, end, upper []byte) (BNode, int, error) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		lo, hi := leafRange(node, start, end)
+		if lo >= hi {
+			return BNode{}, 0, nil
+		}
+		for i := lo; i < hi; i++ {
+			if node.isOverflow(i) {
+				if err := overflowFree(tree, node.getVal(i)); err != nil {
+					return BNode{}, 0, err
+				}
+			}
+		}
+		new := BNode(make([]byte, tree.pageSize()))
+		new.setHeaderPrefix(BNODE_LEAF, node.nkeys()-(hi-lo), node.prefix())
+		nodeAppendRange(new, node, 0, 0, lo)
+		nodeAppendRange(new, node, lo, hi, node.nkeys()-hi)
+		return new, int(hi - lo), nil
+	case BNODE_NODE:
+		return nodeDeleteRange(tree, node, start, end, upper)
+	default:
+		return BNode{}, 0, checkNodeType(node)
+	}
+}
+
+// 叶节点中落在 [start, end) 范围内的索引区间 [lo, hi)，哨兵空键不在范围内
+func leafRange(node BNode, start, end []byte) (uint16, uint16) {
+	lo := nodeLookupLE(node, start)
+	if len(node.getKey(lo)) == 0 || bytes.Compare(node.getKey(lo), start) < 0 {
+		lo++
+	}
+	hi := node.nkeys()
+	if end != nil {
+		hi = nodeLookupLE(node, end)
+		if bytes.Compare(node.getKey(hi), end) < 0 {
+			hi++
+		}
+	}
+	return lo, hi
+}
+
+// 范围删除后内部节点的一个子节点，node 不为空表示子节点被修改过，还没有分配页
+type rangeKid struct {
+	ptr  uint64
+	key  []byte
+	node BNode
+}
+
+// treeDeleteRange()的一部分，从内部节点中删除范围内的键
+func nodeDeleteRange(tree *BTree, node BNode, start, end, upper []byte) (BNode, int, error) {
+	count := 0
+	kids := make([]rangeKid, 0, node.nkeys())
+	for i := uint16(0); i < node.nkeys(); i++ {
+		ptr, key := node.getPtr(i), node.getKey(i)
+		kidUpper := upper
+		if i+1 < node.nkeys() {
+			kidUpper = node.getKey(i + 1)
+		}
+		// 与范围不相交的子节点保持不变
+		before := kidUpper != nil && bytes.Compare(kidUpper, start) <= 0
+		after := end != nil && bytes.Compare(key, end) >= 0
+		if before || after {
+			kids = append(kids, rangeKid{ptr: ptr, key: key})
+			continue
+		}
+		// 整棵子树都在范围内，直接释放；最左边的子树含有哨兵，不会整棵释放
+		inside := len(key) > 0 && bytes.Compare(key, start) >= 0 &&
+			(end == nil || (kidUpper != nil && bytes.Compare(kidUpper, end) <= 0))
+		if inside {
+			n, err := treeFree(tree, ptr)
+			if err != nil {
+				return BNode{}, 0, err
+			}
+			count += n
+			continue
+		}
+		knode, err := treeLoad(tree, ptr)
+		if err != nil {
+			return BNode{}, 0, err
+		}
+		updated, n, err := treeDeleteRange(tree, knode, start, end, kidUpper)
+		treeUnpin(tree, ptr)
+		if err != nil {
+			return BNode{}, 0, err
+		}
+		if n == 0 {
+			kids = append(kids, rangeKid{ptr: ptr, key: key})
+			continue
+		}
+		count += n
+		tree.del(ptr)
+		if updated.nkeys() > 0 {
+			kids = append(kids, rangeKid{node: updated})
+		}
+	}
+	if count == 0 {
+		return BNode{}, 0, nil
+	}
+	kids, err := mergeRangeKids(tree, kids)
+	if err != nil {
+		return BNode{}, 0, err
+	}
+
+	// 修改过的子节点在这里分配页，过大的先分离
+	new := BNode(make([]byte, 2*tree.pageSize()))
+	var ptrs []uint64
+	var keys [][]byte
+	for _, kid := range kids {
+		if len(kid.node) == 0 {
+			ptrs, keys = append(ptrs, kid.ptr), append(keys, kid.key)
+			continue
+		}
+		nsplit, split := nodeSplit3(kid.node, tree.pageSize())
+		for _, knode := range split[:nsplit] {
+			ptrs, keys = append(ptrs, tree.new(knode)), append(keys, knode.getKey(0))
+		}
+	}
+	new.setHeaderPrefix(BNODE_NODE, uint16(len(ptrs)), node.prefix())
+	for i := range ptrs {
+		nodeAppendKV(new, uint16(i), ptrs[i], keys[i], nil)
+	}
+	return new, count, nil
+}
+
+// 修改过的子节点太小时，与相邻的子节点合并，规则与 shouldMerge 相同
+func mergeRangeKids(tree *BTree, kids []rangeKid) ([]rangeKid, error) {
+	for i := 0; i < len(kids); i++ {
+		kid := kids[i].node
+		if len(kid) == 0 || int(kid.nbytes()) > tree.nodeSize()/4 {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(kids) {
+				continue
+			}
+			sibling := kids[j].node
+			if len(sibling) == 0 {
+				var err error
+				if sibling, err = treeLoad(tree, kids[j].ptr); err != nil {
+					return nil, err
+				}
+			}
+			left, right := sibling, kid
+			if j > i {
+				left, right = kid, sibling
+			}
+			if nodeMergedSize(left, right) > tree.nodeSize() {
+				if len(kids[j].node) == 0 {
+					treeUnpin(tree, kids[j].ptr)
+				}
+				continue
+			}
+			merged := BNode(make([]byte, tree.pageSize()))
+			nodeMerge(merged, left, right)
+			if len(kids[j].node) == 0 {
+				treeUnpin(tree, kids[j].ptr)
+				tree.del(kids[j].ptr)
+			}
+			k := min(i, j)
+			kids[k] = rangeKid{node: merged}
+			kids = append(kids[:k+1], kids[k+2:]...)
+			i = k - 1 // 合并后的节点可能还需要合并
+			break
+		}
+	}
+	return kids, nil
+}
+
+// 释放以 ptr 为根的整棵子树，包括值的溢出页，返回其中的键数
+func treeFree(tree *BTree, ptr uint64) (int, error) {
+	node, err := treeLoad(tree, ptr)
+	if err != nil {
+		return 0, err
+	}
+	defer treeUnpin(tree, ptr)
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			n, err := treeFree(tree, node.getPtr(i))
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		} else if node.isOverflow(i) {
+			if err := overflowFree(tree, node.getVal(i)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if node.btype() == BNODE_LEAF {
+		count = int(node.nkeys())
+	}
+	tree.del(ptr)
+	return count, nil
 }
 
 // treeInsert()的一部分，KV 插入对于internal 节点
-func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key []byte, val []byte) {
+// 子节点没有修改时返回空
+func nodeInsert(tree *BTree, node BNode, idx uint16, req *UpdateReq, upper []byte) ([]BNode, error) {
 	kptr := node.getPtr(idx)
+	knode, err := treeLoad(tree, kptr)
+	if err != nil {
+		return nil, err
+	}
+	defer treeUnpin(tree, kptr)
+	kidUpper := upper
+	if idx+1 < node.nkeys() {
+		kidUpper = node.getKey(idx + 1)
+	}
 	//递归插入子节点
-	knode := treeInsert(tree, tree.get(kptr), key, val)
-	//分离结果
-	nsplit, split := nodeSplit3(knode)
+	kids, err := treeInsert(tree, knode, req, kidUpper)
+	if err != nil || len(kids) == 0 {
+		return nil, err
+	}
 	//释放子节点
 	tree.del(kptr)
+	// 不共享前缀的子节点只可能在最后，与叶节点一样放到新的右兄弟节点中
+	n := len(kids)
+	for n > 1 && !bytes.HasPrefix(kids[n-1].getKey(0), node.prefix()) {
+		n--
+	}
 	//更新子的连接
-	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	new := BNode(make([]byte, 2*tree.pageSize()))
+	nodeReplaceKidN(tree, new, node, idx, kids[:n]...)
+	var sibling BNode
+	if n < len(kids) {
+		sibling = BNode(make([]byte, tree.pageSize()))
+		nodeLinkKids(tree, sibling, node.prefix()[:0], kids[n:])
+	}
+	return splitKids(tree, new, sibling, upper), nil
 }
 
 // 更新后的子节点是否应该与兄弟节点合并？
-func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
-		return 0, BNode{}
+// 返回的兄弟节点由调用者合并之后释放
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode, error) {
+	if int(updated.nbytes()) > tree.nodeSize()/4 {
+		return 0, BNode{}, nil
 	}
 	if idx > 0 {
-		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return -1, sibling //左
+		sibling, err := treeLoad(tree, node.getPtr(idx-1))
+		if err != nil {
+			return 0, BNode{}, err
 		}
+		if nodeMergedSize(sibling, updated) <= tree.nodeSize() {
+			return -1, sibling, nil //左
+		}
+		treeUnpin(tree, node.getPtr(idx-1))
 	}
 	if idx+1 < node.nkeys() {
-		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return +1, sibling //右
+		sibling, err := treeLoad(tree, node.getPtr(idx+1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		if nodeMergedSize(updated, sibling) <= tree.nodeSize() {
+			return +1, sibling, nil //右
 		}
+		treeUnpin(tree, node.getPtr(idx+1))
 	}
-	return 0, BNode{}
+	return 0, BNode{}, nil
 }
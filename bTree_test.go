@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
+	"slices"
 	"strings"
 	"testing"
 	"unsafe"
@@ -48,30 +52,81 @@ func (c *C) PrintTree() {
 	}
 }
 
-func treeSearch(tree *BTree, ptr uint64, key []byte) ([]byte, bool) {
-	node := BNode(tree.get(ptr))
-	idx := nodeLookupLE(node, key)
-	if idx == 0{
-		return nil, false
-	}
-	switch node.btype() {
-	case BNODE_LEAF:
-		if bytes.Equal(node.getKey(idx), key) {
-			return node.getVal(idx), true
-		}
-	case BNODE_NODE:
-		return treeSearch(tree, node.getPtr(idx), key)
-	default:
-		panic("treeSearch: bad node type")
-	}
-	return nil, false
-}
-
 func (c *C) add(key string, val string) {
 	c.tree.Insert([]byte(key), []byte(val))
 	c.ref[key] = val
 }
 
+// 检查树的结构和内容：叶节点深度相同、分隔键等于子节点的第一个键、
+// 没有空节点、子树中的键都以祖先节点的前缀开头、内容与 c.ref 一致、没有泄漏的页
+func (c *C) verify(t *testing.T) {
+	t.Helper()
+	if c.tree.root == 0 {
+		if len(c.ref) != 0 || len(c.pages) != 0 {
+			t.Errorf("空树: 引用 %d 个键, %d 页", len(c.ref), len(c.pages))
+		}
+		return
+	}
+	var keys []string
+	npages, depth := 0, -1
+	var walk func(ptr uint64, level int, prefix []byte)
+	walk = func(ptr uint64, level int, prefix []byte) {
+		npages++
+		node := BNode(c.tree.get(ptr))
+		if node.nkeys() == 0 || int(node.nbytes()) > c.tree.nodeSize() {
+			t.Fatalf("节点 %d: %d 个键, %d 字节", ptr, node.nkeys(), node.nbytes())
+		}
+		if len(node.prefix()) > len(prefix) {
+			prefix = node.prefix()
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !bytes.HasPrefix(node.getKey(i), prefix) {
+				t.Fatalf("键 %q 不以祖先节点的前缀 %q 开头", node.getKey(i), prefix)
+			}
+			if node.btype() == BNODE_NODE {
+				kid := BNode(c.tree.get(node.getPtr(i)))
+				if !bytes.Equal(node.getKey(i), kid.getKey(0)) {
+					t.Fatalf("分隔键 %q 不等于子节点的第一个键 %q", node.getKey(i), kid.getKey(0))
+				}
+				walk(node.getPtr(i), level+1, prefix)
+				continue
+			}
+			if node.isOverflow(i) {
+				for ptr := binary.LittleEndian.Uint64(node.getVal(i)[8:]); ptr != 0; {
+					npages++
+					ptr = binary.LittleEndian.Uint64(c.tree.get(ptr)[4:12])
+				}
+			}
+			keys = append(keys, string(node.getKey(i)))
+		}
+		if node.btype() == BNODE_LEAF {
+			if depth >= 0 && depth != level {
+				t.Fatalf("叶节点深度不同: %d 和 %d", depth, level)
+			}
+			depth = level
+		}
+	}
+	walk(c.tree.root, 0, nil)
+
+	if len(keys) == 0 || keys[0] != "" {
+		t.Fatal("缺少哨兵空键")
+	}
+	if !slices.IsSorted(keys) {
+		t.Fatal("键没有排序")
+	}
+	if len(keys)-1 != len(c.ref) {
+		t.Fatalf("键数量错误: 期望 %d, 得到 %d", len(c.ref), len(keys)-1)
+	}
+	for _, key := range keys[1:] {
+		if val, found, _ := c.tree.Get([]byte(key)); !found || string(val) != c.ref[key] {
+			t.Fatalf("键 %q 的值错误", key)
+		}
+	}
+	if npages != len(c.pages) {
+		t.Errorf("页泄漏: 可达 %d 页, 共 %d 页", npages, len(c.pages))
+	}
+}
+
 func TestBTreeInsert(t *testing.T) {
 	t.Run("插入到空树", func(t *testing.T) {
 		c := newC() // 使用之前定义的测试辅助结构
@@ -107,7 +162,7 @@ func TestBTreeInsert(t *testing.T) {
 		// 验证所有键都存在
 		for i := 0; i < 50; i++ {
 			key := []byte(fmt.Sprintf("key%03d", i))
-			foundVal, found := treeSearch(&c.tree, c.tree.root, key)
+			foundVal, found, _ := c.tree.Get(key)
 			if !found {
 				t.Errorf("键未找到：%q", key)
 			}
@@ -118,6 +173,244 @@ func TestBTreeInsert(t *testing.T) {
 	})
 }
 
+func TestBTreeGet(t *testing.T) {
+	t.Run("空树", func(t *testing.T) {
+		c := newC()
+		if _, found, _ := c.tree.Get([]byte("any")); found {
+			t.Error("空树中不应找到任何键")
+		}
+	})
+
+	t.Run("哨兵空键不可见", func(t *testing.T) {
+		c := newC()
+		c.add("key1", "val1")
+		if _, found, _ := c.tree.Get(nil); found {
+			t.Error("哨兵空键不应被查到")
+		}
+		if _, found, _ := c.tree.Get([]byte{}); found {
+			t.Error("哨兵空键不应被查到")
+		}
+	})
+
+	t.Run("多层树查找", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			c.add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i))
+		}
+		if BNode(c.tree.get(c.tree.root)).btype() != BNODE_NODE {
+			t.Fatal("根节点应为内部节点")
+		}
+		for key, val := range c.ref {
+			got, found, _ := c.tree.Get([]byte(key))
+			if !found {
+				t.Errorf("键未找到：%q", key)
+				continue
+			}
+			if string(got) != val {
+				t.Errorf("键 %q 的值不匹配: 期望 %q, 得到 %q", key, val, got)
+			}
+		}
+		for _, key := range []string{"a", "key", "key0000", "key999x", "z"} {
+			if _, found, _ := c.tree.Get([]byte(key)); found {
+				t.Errorf("不存在的键被找到：%q", key)
+			}
+		}
+	})
+
+	t.Run("返回值是拷贝", func(t *testing.T) {
+		c := newC()
+		c.add("key1", "val1")
+		got, _, _ := c.tree.Get([]byte("key1"))
+		got[0] = 'X'
+		again, _, _ := c.tree.Get([]byte("key1"))
+		if string(again) != "val1" {
+			t.Errorf("修改返回值影响了页内存: 得到 %q", again)
+		}
+	})
+
+	t.Run("删除后查找", func(t *testing.T) {
+		c := newC()
+		c.add("key1", "val1")
+		c.add("key2", "val2")
+		if ok, _ := c.tree.Delete([]byte("key1")); !ok {
+			t.Fatal("删除失败")
+		}
+		if _, found, _ := c.tree.Get([]byte("key1")); found {
+			t.Error("已删除的键仍然存在")
+		}
+		if got, found, _ := c.tree.Get([]byte("key2")); !found || string(got) != "val2" {
+			t.Errorf("键 key2 查找错误: %q %v", got, found)
+		}
+	})
+}
+
+func TestBTreeInsertEx(t *testing.T) {
+	cases := []struct {
+		mode           int
+		exists         bool
+		added, updated bool
+	}{
+		{MODE_UPSERT, false, true, true},
+		{MODE_UPSERT, true, false, true},
+		{MODE_UPDATE_ONLY, false, false, false},
+		{MODE_UPDATE_ONLY, true, false, true},
+		{MODE_INSERT_ONLY, false, true, true},
+		{MODE_INSERT_ONLY, true, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("mode=%d,exists=%v", tc.mode, tc.exists), func(t *testing.T) {
+			c := newC()
+			for i := 0; i < 500; i++ {
+				c.add(fmt.Sprintf("key%03d", i), "old")
+			}
+			key := "key100"
+			if !tc.exists {
+				key = "key100x"
+			}
+			root := c.tree.root
+			req := &UpdateReq{Key: []byte(key), Val: []byte("new"), Mode: tc.mode}
+			if err := c.tree.InsertEx(req); err != nil {
+				t.Fatal(err)
+			}
+			if req.Added != tc.added || req.Updated != tc.updated {
+				t.Errorf("结果错误: Added=%v Updated=%v", req.Added, req.Updated)
+			}
+			if tc.exists && string(req.Old) != "old" {
+				t.Errorf("旧值错误: 得到 %q", req.Old)
+			}
+			if !tc.exists && req.Old != nil {
+				t.Errorf("新键不应有旧值: 得到 %q", req.Old)
+			}
+			if !tc.updated && c.tree.root != root {
+				t.Error("拒绝的写入不应复制节点")
+			}
+			val, found, _ := c.tree.Get([]byte(key))
+			switch {
+			case tc.updated && string(val) != "new":
+				t.Errorf("写入后的值错误: 得到 %q", val)
+			case !tc.updated && tc.exists && string(val) != "old":
+				t.Errorf("值不应被修改: 得到 %q", val)
+			case !tc.updated && !tc.exists && found:
+				t.Error("键不应被插入")
+			}
+		})
+	}
+
+	t.Run("值没有变化", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 500; i++ {
+			c.add(fmt.Sprintf("key%03d", i), "same")
+		}
+		big := strings.Repeat("x", 3*BTREE_MAX_VAL_SIZE)
+		c.add("big", big)
+		root, npages := c.tree.root, len(c.pages)
+		for key, val := range map[string]string{"key100": "same", "big": big} {
+			req := &UpdateReq{Key: []byte(key), Val: []byte(val)}
+			if err := c.tree.InsertEx(req); err != nil {
+				t.Fatal(err)
+			}
+			if req.Updated || string(req.Old) != val {
+				t.Errorf("键 %q: Updated=%v", key, req.Updated)
+			}
+		}
+		if c.tree.root != root || len(c.pages) != npages {
+			t.Error("值没有变化时不应复制节点")
+		}
+	})
+
+	t.Run("空树", func(t *testing.T) {
+		c := newC()
+		req := &UpdateReq{Key: []byte("k"), Val: []byte("v"), Mode: MODE_UPDATE_ONLY}
+		if err := c.tree.InsertEx(req); err != nil || req.Updated || c.tree.root != 0 {
+			t.Errorf("空树中只更新不应创建根节点: %v %v", err, req.Updated)
+		}
+	})
+}
+
+func TestBTreeCompareAndSwap(t *testing.T) {
+	cases := []struct {
+		name     string
+		key      string
+		expected []byte
+		swapped  bool
+	}{
+		{"当前值相等", "key100", []byte("old"), true},
+		{"当前值不等", "key100", []byte("other"), false},
+		{"期望不存在但键存在", "key100", nil, false},
+		{"期望不存在且键不存在", "key100x", nil, true},
+		{"期望某个值但键不存在", "key100x", []byte("old"), false},
+		{"期望空值但键不存在", "key100x", []byte{}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newC()
+			for i := 0; i < 500; i++ {
+				c.add(fmt.Sprintf("key%03d", i), "old")
+			}
+			before, existed, _ := c.tree.Get([]byte(tc.key))
+			swapped, err := c.tree.CompareAndSwap([]byte(tc.key), tc.expected, []byte("new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swapped != tc.swapped {
+				t.Errorf("比较结果错误: 期望 %v, 得到 %v", tc.swapped, swapped)
+			}
+			val, found, _ := c.tree.Get([]byte(tc.key))
+			switch {
+			case swapped && string(val) != "new":
+				t.Errorf("交换后的值错误: 得到 %q", val)
+			case !swapped && (found != existed || !bytes.Equal(val, before)):
+				t.Errorf("比较失败时值不应被修改: 得到 %q", val)
+			}
+		})
+	}
+
+	t.Run("空值和不存在不同", func(t *testing.T) {
+		c := newC()
+		c.add("k", "")
+		if ok, _ := c.tree.CompareAndSwap([]byte("k"), nil, []byte("v")); ok {
+			t.Error("键存在时期望不存在应失败")
+		}
+		if ok, _ := c.tree.CompareAndSwap([]byte("k"), []byte{}, []byte("v")); !ok {
+			t.Error("期望空值应成功")
+		}
+	})
+
+	t.Run("新值等于当前值", func(t *testing.T) {
+		c := newC()
+		c.add("k", "v")
+		root := c.tree.root
+		if ok, _ := c.tree.CompareAndSwap([]byte("k"), []byte("v"), []byte("v")); !ok {
+			t.Error("比较应成功")
+		}
+		if c.tree.root != root {
+			t.Error("值没有变化时不应复制节点")
+		}
+	})
+
+	t.Run("大值", func(t *testing.T) {
+		c := newC()
+		big := []byte(strings.Repeat("x", 3*BTREE_MAX_VAL_SIZE))
+		c.add("k", string(big))
+		if ok, _ := c.tree.CompareAndSwap([]byte("k"), big[1:], []byte("v")); ok {
+			t.Error("长度不同的期望值应失败")
+		}
+		if ok, _ := c.tree.CompareAndSwap([]byte("k"), big, []byte("v")); !ok {
+			t.Error("比较应成功")
+		}
+		if val, _, _ := c.tree.Get([]byte("k")); string(val) != "v" {
+			t.Errorf("交换后的值错误: 得到 %q", val)
+		}
+	})
+
+	t.Run("非法的键", func(t *testing.T) {
+		c := newC()
+		if _, err := c.tree.CompareAndSwap(nil, nil, []byte("v")); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("期望 ErrEmptyKey, 得到 %v", err)
+		}
+	})
+}
+
 func TestTreeDelete(t *testing.T) {
 	t.Run("delete from leaf node", func(t *testing.T) {
 		c := newC()
@@ -138,7 +431,10 @@ func TestTreeDelete(t *testing.T) {
 		testKV(t, c.tree.get(c.tree.root), 3, []byte("key3"), []byte("val3"))
 		leaf := BNode(c.tree.get(leafPtr))
 		// Test deletion
-		result := treeDelete(&c.tree, leaf, []byte("key2"))
+		result, err := treeDelete(&c.tree, leaf, &DeleteReq{Key: []byte("key2")})
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(result) == 0 {
 			t.Error("Failed to delete existing key")
 		}
@@ -160,7 +456,10 @@ func TestTreeDelete(t *testing.T) {
 		}
 		leaf := BNode(c.tree.get(leafPtr))
 
-		result := treeDelete(&c.tree, leaf, []byte("nonexistent"))
+		result, err := treeDelete(&c.tree, leaf, &DeleteReq{Key: []byte("nonexistent")})
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(result) != 0 {
 			t.Error("Expected empty result for non-existent key")
 		}
@@ -185,13 +484,16 @@ func TestTreeDelete(t *testing.T) {
 
 		// Test deletion
 		testKey := []byte("key050")
-		result := treeDelete(&c.tree, root, testKey)
+		result, err := treeDelete(&c.tree, root, &DeleteReq{Key: testKey})
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(result) == 0 {
 			t.Error("Failed to delete from internal node")
 		}
 
 		// Verify the key is actually gone
-		if _, found := treeSearch(&c.tree, c.tree.root, testKey); found {
+		if _, found, _ := treeGet(&c.tree, result, testKey); found {
 			t.Error("Key still exists after deletion")
 		}
 	})
@@ -201,13 +503,351 @@ func TestTreeDelete(t *testing.T) {
 		badNode := BNode(make([]byte, BTREE_PAGE_SIZE))
 		badNode.setHeader(3, 0) // Invalid type
 
-		defer func() {
-			if r := recover(); r == nil {
-				t.Error("Expected panic for bad node type")
+		if _, err := treeDelete(&c.tree, badNode, &DeleteReq{Key: []byte("any")}); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("Expected ErrCorruptPage for bad node type, got %v", err)
+		}
+	})
+}
+
+func TestBTreeErrors(t *testing.T) {
+	t.Run("非法的键值对", func(t *testing.T) {
+		c := newC()
+		c.add("key1", "val1")
+		cases := []struct {
+			key, val []byte
+			err      error
+		}{
+			{nil, []byte("v"), ErrEmptyKey},
+			{[]byte{}, []byte("v"), ErrEmptyKey},
+			{make([]byte, BTREE_MAX_KEY_SIZE+1), []byte("v"), ErrKeyTooLarge},
+			{[]byte("k"), make([]byte, BTREE_MAX_OVERFLOW_SIZE+1), ErrValueTooLarge},
+		}
+		root := c.tree.root
+		for _, tc := range cases {
+			if err := c.tree.Insert(tc.key, tc.val); !errors.Is(err, tc.err) {
+				t.Errorf("期望 %v, 得到 %v", tc.err, err)
+			}
+		}
+		if c.tree.root != root {
+			t.Error("非法的写入不应修改树")
+		}
+		if _, err := c.tree.Delete(nil); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("删除空键: 期望 ErrEmptyKey, 得到 %v", err)
+		}
+		// 最大的键仍然可以写入
+		key := bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE)
+		if err := c.tree.Insert(key, make([]byte, BTREE_MAX_VAL_SIZE)); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := c.tree.Get(key); !found {
+			t.Error("最大的键没有找到")
+		}
+	})
+
+	t.Run("损坏的页", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			c.add(fmt.Sprintf("key%03d", i), "value")
+		}
+		root := BNode(c.tree.get(c.tree.root))
+		kptr := root.getPtr(0)
+		BNode(c.pages[kptr]).setHeader(7, 0)
+
+		err := c.tree.Insert([]byte("key000"), []byte("new"))
+		if !errors.Is(err, ErrCorruptPage) {
+			t.Fatalf("期望 ErrCorruptPage, 得到 %v", err)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("page %d", kptr)) {
+			t.Errorf("错误信息中应包含页号 %d: %v", kptr, err)
+		}
+		if _, err := c.tree.Delete([]byte("key000")); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("期望 ErrCorruptPage, 得到 %v", err)
+		}
+	})
+}
+
+func TestBTreeDeleteEx(t *testing.T) {
+	c := newC()
+	keys := fillC(c, 500)
+	big := strings.Repeat("x", 3*BTREE_MAX_VAL_SIZE)
+	c.add("big", big)
+	for _, key := range []string{keys[100], "big"} {
+		req := &DeleteReq{Key: []byte(key)}
+		deleted, err := c.tree.DeleteEx(req)
+		if err != nil || !deleted {
+			t.Fatalf("删除 %q 失败: %v", key, err)
+		}
+		if string(req.Old) != c.ref[key] {
+			t.Errorf("键 %q 的旧值错误: 得到长度 %d", key, len(req.Old))
+		}
+		delete(c.ref, key)
+	}
+	req := &DeleteReq{Key: []byte("missing")}
+	if deleted, _ := c.tree.DeleteEx(req); deleted || req.Old != nil {
+		t.Errorf("不存在的键: deleted=%v old=%q", deleted, req.Old)
+	}
+	c.verify(t)
+}
+
+func TestBTreeDeleteRange(t *testing.T) {
+	t.Run("整个前缀", func(t *testing.T) {
+		c := newC()
+		for _, tenant := range []string{"a", "b", "c"} {
+			for i := 0; i < 2000; i++ {
+				c.add(fmt.Sprintf("%s/%05d", tenant, i), strings.Repeat("v", 50))
+			}
+		}
+		count, err := c.tree.DeleteRange([]byte("b/"), []byte("b0"))
+		if err != nil || count != 2000 {
+			t.Fatalf("删除数量错误: %d %v", count, err)
+		}
+		for key := range c.ref {
+			if strings.HasPrefix(key, "b/") {
+				delete(c.ref, key)
+			}
+		}
+		c.verify(t)
+	})
+
+	t.Run("全部删除", func(t *testing.T) {
+		c := newC()
+		fillC(c, 3000)
+		c.add("big", strings.Repeat("x", 3*BTREE_MAX_VAL_SIZE))
+		count, err := c.tree.DeleteRange(nil, nil)
+		if err != nil || count != 3001 {
+			t.Fatalf("删除数量错误: %d %v", count, err)
+		}
+		c.ref = map[string]string{}
+		c.verify(t)
+		if len(c.pages) != 1 {
+			t.Errorf("只应剩下一个只有哨兵的叶节点: %d 页", len(c.pages))
+		}
+		c.add("k", "v")
+		c.verify(t)
+	})
+
+	t.Run("空范围", func(t *testing.T) {
+		c := newC()
+		fillC(c, 1000)
+		root := c.tree.root
+		for _, r := range [][2]string{{"key0500", "key0500"}, {"key0600", "key0500"}, {"key0100x", "key0101"}, {"z", ""}} {
+			end := []byte(r[1])
+			if r[1] == "" {
+				end = nil
 			}
-		}()
+			if count, _ := c.tree.DeleteRange([]byte(r[0]), end); count != 0 {
+				t.Errorf("范围 %q 不应删除任何键: %d", r, count)
+			}
+		}
+		if c.tree.root != root {
+			t.Error("没有删除时不应复制节点")
+		}
+	})
 
-		treeDelete(&c.tree, badNode, []byte("any"))
+	t.Run("随机范围", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		for round := 0; round < 50; round++ {
+			c := newC()
+			n := rng.Intn(3000) + 1
+			for i := 0; i < n; i++ {
+				c.add(fmt.Sprintf("key%05d", rng.Intn(10000)), strings.Repeat("v", rng.Intn(200)))
+			}
+			for j := 0; j < 5; j++ {
+				a, b := rng.Intn(11000), rng.Intn(11000)
+				start, end := []byte(fmt.Sprintf("key%05d", min(a, b))), []byte(fmt.Sprintf("key%05d", max(a, b)))
+				if j == 4 {
+					end = nil
+				}
+				expected := 0
+				for key := range c.ref {
+					if key >= string(start) && (end == nil || key < string(end)) {
+						delete(c.ref, key)
+						expected++
+					}
+				}
+				count, err := c.tree.DeleteRange(start, end)
+				if err != nil || count != expected {
+					t.Fatalf("范围 [%q, %q): 期望删除 %d, 得到 %d %v", start, end, expected, count, err)
+				}
+				c.verify(t)
+			}
+		}
+	})
+
+	t.Run("损坏的页", func(t *testing.T) {
+		c := newC()
+		fillC(c, 1000)
+		root := BNode(c.tree.get(c.tree.root))
+		c.pages[root.getPtr(1)].setHeader(0, 1)
+		if _, err := c.tree.DeleteRange(nil, nil); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("期望 ErrCorruptPage, 得到 %v", err)
+		}
+	})
+}
+
+func TestBTreePageSize(t *testing.T) {
+	for _, size := range []int{4 << 10, 8 << 10, 16 << 10, 32 << 10, 64 << 10} {
+		t.Run(fmt.Sprintf("%dK", size>>10), func(t *testing.T) {
+			c := newC()
+			c.tree.size = size
+			maxKey, maxVal := maxKeySizeOf(size), maxValSizeOf(size)
+			if HEADER+8+2+4+maxKey+maxVal > nodeSizeOf(size) {
+				t.Fatal("最大的键值对放不进一个节点")
+			}
+			rng := rand.New(rand.NewSource(int64(size)))
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("key%05d", rng.Intn(5000))
+				var val string
+				switch i % 100 {
+				case 0:
+					key += strings.Repeat("k", maxKey-len(key)) // 最大的键
+					val = strings.Repeat("v", maxVal)           // 最大的内联值
+				case 1:
+					val = strings.Repeat("o", maxVal+1) // 刚好进入溢出页
+				case 2:
+					val = strings.Repeat("b", 3*size) // 多个溢出页
+				default:
+					val = strings.Repeat("v", rng.Intn(size/10))
+				}
+				c.add(key, val)
+			}
+			c.verify(t)
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key%05d", rng.Intn(5000))
+				c.tree.Delete([]byte(key))
+				delete(c.ref, key)
+			}
+			c.verify(t)
+			count, err := c.tree.DeleteRange([]byte("key01000"), []byte("key03000"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key := range c.ref {
+				if key >= "key01000" && key < "key03000" {
+					delete(c.ref, key)
+					count--
+				}
+			}
+			if count != 0 {
+				t.Errorf("范围删除的数量错误: 相差 %d", count)
+			}
+			c.verify(t)
+
+			long := strings.Repeat("k", maxKey+1)
+			if err := c.tree.Insert([]byte(long), nil); !errors.Is(err, ErrKeyTooLarge) {
+				t.Errorf("期望 ErrKeyTooLarge, 得到 %v", err)
+			}
+		})
+	}
+
+	t.Run("非法的页大小", func(t *testing.T) {
+		for _, size := range []int{0, 2048, 5000, 128 << 10} {
+			if checkPageSize(size) == nil {
+				t.Errorf("页大小 %d 应被拒绝", size)
+			}
+		}
+	})
+}
+
+// 共享很长前缀的键，例如 tenant/00000003/user/00000042
+func prefixKey(tenant, user int) string {
+	return fmt.Sprintf("tenant/%08d/user/%08d", tenant, user)
+}
+
+func TestBTreePrefix(t *testing.T) {
+	t.Run("随机插入和删除", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		c := newC()
+		c.tree.prefix = true
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 3000; i++ {
+				c.add(prefixKey(rng.Intn(20), rng.Intn(1000)), strings.Repeat("v", rng.Intn(100)))
+			}
+			c.verify(t)
+			for i := 0; i < 2000; i++ {
+				key := prefixKey(rng.Intn(20), rng.Intn(1000))
+				c.tree.Delete([]byte(key))
+				delete(c.ref, key)
+			}
+			c.verify(t)
+			tenant := rng.Intn(20)
+			start, end := prefixKey(tenant, rng.Intn(1000)), prefixKey(tenant+1, rng.Intn(1000))
+			if _, err := c.tree.DeleteRange([]byte(start), []byte(end)); err != nil {
+				t.Fatal(err)
+			}
+			for key := range c.ref {
+				if key >= start && key < end {
+					delete(c.ref, key)
+				}
+			}
+			c.verify(t)
+		}
+	})
+
+	t.Run("前缀之外的键", func(t *testing.T) {
+		// 删除一段范围之后，左边的节点的范围扩大，再插入的键不共享它的前缀
+		c := newC()
+		c.tree.prefix = true
+		for i := 0; i < 3000; i++ {
+			c.add(fmt.Sprintf("p/%04d", i), strings.Repeat("v", 20))
+		}
+		if _, err := c.tree.DeleteRange([]byte("p/1000"), []byte("p/2000")); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1000; i < 2000; i++ {
+			delete(c.ref, fmt.Sprintf("p/%04d", i))
+		}
+		c.verify(t)
+		for i := 1999; i >= 1000; i-- {
+			c.add(fmt.Sprintf("p/%04d", i), strings.Repeat("w", i%50))
+		}
+		c.verify(t)
+		for i := 0; i < 3000; i += 2 {
+			key := fmt.Sprintf("p/%04d", i)
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		}
+		c.verify(t)
+	})
+
+	t.Run("扇出更大", func(t *testing.T) {
+		// 顺序插入时分裂出的左边节点不会再插入新的键，只有随机插入才能填满压缩后的节点
+		plain, compressed := newC(), newC()
+		compressed.tree.prefix = true
+		for _, i := range rand.New(rand.NewSource(1)).Perm(10000) {
+			plain.add(prefixKey(i/1000, i%1000), "v")
+			compressed.add(prefixKey(i/1000, i%1000), "v")
+		}
+		plain.verify(t)
+		compressed.verify(t)
+		if len(compressed.pages)*5 > len(plain.pages)*3 {
+			t.Errorf("前缀压缩后的页数 %d 应比原来的 %d 少 40%% 以上", len(compressed.pages), len(plain.pages))
+		}
+	})
+
+	t.Run("格式混合", func(t *testing.T) {
+		// 节点的格式记录在各自的页中，修改已有的树时沿用原来的格式
+		c := newC()
+		fillC(c, 1000)
+		c.tree.prefix = true
+		for i := 0; i < 1000; i++ {
+			c.add(prefixKey(1, i), "v")
+		}
+		c.verify(t)
+		for _, node := range c.pages {
+			if node.prefix() != nil {
+				t.Fatal("已有的树不应出现前缀压缩的节点")
+			}
+		}
+	})
+
+	t.Run("损坏的前缀长度", func(t *testing.T) {
+		node := BNode(make([]byte, BTREE_PAGE_SIZE))
+		node.setHeaderPrefix(BNODE_LEAF, 1, []byte("abc"))
+		binary.LittleEndian.PutUint16(node[HEADER:], BTREE_PAGE_SIZE)
+		if err := checkNodeType(node); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("期望 ErrCorruptPage, 得到 %v", err)
+		}
 	})
 }
 
@@ -222,7 +862,7 @@ func TestBTree(t *testing.T) {
 		for _, key := range []string{"a", "b", "c", "d", "z"} {
 			currentKey := []byte(key)
 			// 检查键是否存在
-			val, found := treeSearch(&c.tree, c.tree.root, currentKey)
+			val, found, _ := c.tree.Get(currentKey)
 			if !found {
 				t.Errorf("键 %q 未找到", key)
 			}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 在线备份
+//
+// 树是写时复制的，读事务看到的页在它结束之前不会被覆盖，
+// 因此在一个读事务中就能复制出一致的数据库文件，写入者照常提交。
+// 备份只包含树中可达的页，按先序遍历重新编号，溢出页紧跟在引用它的叶节点之后，
+// 空闲链表是空的。页大小、前缀压缩和校验和的设置与原文件相同。
+//
+// 备份文件的布局：
+// | meta | free list | root | ... |
+// 第一遍遍历为每一页分配新的页号，第二遍复制页并改写其中的页号，
+// 因为元数据页在文件开头，需要先知道根节点和总页数。
+
+// 备份文件中树的第一页，之前是元数据页和空闲链表的第一个节点
+const BACKUP_FIRST_PAGE = 2
+
+// 备份中的一页
+type backupPage struct {
+	ptr      uint64 // 原文件中的页号
+	overflow bool
+}
+
+type backup struct {
+	tree   *BTree
+	pages  []backupPage      // 按备份文件中的顺序排列
+	newPtr map[uint64]uint64 // 原页号到备份文件中页号的映射
+}
+
+// 将数据库的一个一致的快照写入 w，写出的内容是一个完整的数据库文件
+// 备份期间不阻塞写事务，但备份读取的快照中的页在结束之前不能被重用
+// 读事务只对本进程的写入者可见，在线备份要在打开数据库的进程中调用
+func (db *KV) Backup(w io.Writer) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer tx.Abort()
+	b := &backup{tree: &tx.tree, newPtr: map[uint64]uint64{}}
+	if tx.tree.root != 0 {
+		if err := b.collect(tx.tree.root); err != nil {
+			return err
+		}
+	}
+
+	// 元数据页，空的空闲链表与新建的文件相同
+	out := &KV{PageSize: db.PageSize, PrefixCompression: db.PrefixCompression, checksum: db.checksum}
+	out.tree.root = b.newPtr[tx.tree.root]
+	out.page.flushed = BACKUP_FIRST_PAGE + uint64(len(b.pages))
+	out.free.headPage = 1
+	out.free.tailPage = 1
+	meta := make([]byte, db.PageSize)
+	copy(meta, saveMeta(out))
+	if _, err := w.Write(meta); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if _, err := w.Write(b.page(db, 1, nil)); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	for i, p := range b.pages {
+		data, err := treePage(b.tree, p.ptr)
+		if err != nil {
+			return err
+		}
+		page := b.page(db, BACKUP_FIRST_PAGE+uint64(i), func(node []byte) {
+			copy(node, data)
+			b.rewrite(BNode(node), p.overflow)
+		})
+		treeUnpin(b.tree, p.ptr)
+		if _, err := w.Write(page); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// 先序遍历以 ptr 为根的子树，为每一页分配备份文件中的页号
+func (b *backup) collect(ptr uint64) error {
+	b.add(ptr, false)
+	node, err := treeLoad(b.tree, ptr)
+	if err != nil {
+		return err
+	}
+	defer treeUnpin(b.tree, ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := b.collect(node.getPtr(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if !node.isOverflow(i) {
+			continue
+		}
+		// 链表的页数由值的大小决定，损坏的链表可能有环
+		n, err := overflowPages(b.tree, node.getVal(i))
+		if err != nil {
+			return err
+		}
+		ptr := binary.LittleEndian.Uint64(node.getVal(i)[8:16])
+		for ; ptr != 0 && n > 0; n-- {
+			b.add(ptr, true)
+			page, err := treePage(b.tree, ptr)
+			if err != nil {
+				return err
+			}
+			next := binary.LittleEndian.Uint64(page[4:12])
+			treeUnpin(b.tree, ptr)
+			ptr = next
+		}
+		if ptr != 0 {
+			return fmt.Errorf("page %d: %w: overflow chain longer than its value", ptr, ErrCorruptPage)
+		}
+	}
+	return nil
+}
+
+func (b *backup) add(ptr uint64, overflow bool) {
+	b.newPtr[ptr] = BACKUP_FIRST_PAGE + uint64(len(b.pages))
+	b.pages = append(b.pages, backupPage{ptr: ptr, overflow: overflow})
+}
+
+// 把复制出的页中指向其他页的页号改为备份文件中的页号
+func (b *backup) rewrite(node BNode, overflow bool) {
+	if overflow {
+		if next := binary.LittleEndian.Uint64(node[4:12]); next != 0 {
+			binary.LittleEndian.PutUint64(node[4:12], b.newPtr[next])
+		}
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		switch {
+		case node.btype() == BNODE_NODE:
+			node.setPtr(i, b.newPtr[node.getPtr(i)])
+		case node.isOverflow(i):
+			ref := node.getVal(i)
+			binary.LittleEndian.PutUint64(ref[8:16], b.newPtr[binary.LittleEndian.Uint64(ref[8:16])])
+		}
+	}
+}
+
+// 生成备份文件中第 ptr 页的完整内容，fill 填写页头之后的部分，页头的校验和按新的页号计算
+func (b *backup) page(db *KV, ptr uint64, fill func(node []byte)) []byte {
+	page := make([]byte, db.PageSize)
+	if fill != nil {
+		fill(page[db.pageHeader():])
+	}
+	if db.checksum {
+		pageSetChecksum(page, ptr)
+	}
+	return page
+}
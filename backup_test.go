@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 把 db 备份到 path
+func backupTo(t *testing.T, db *KV, path string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatalf("备份失败: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("只包含可达的页", func(t *testing.T) {
+		dir := t.TempDir()
+		db := openTestKV(t, filepath.Join(dir, "test.db"))
+		defer db.Close()
+		ref := map[string]string{}
+		for i := 0; i < 3000; i++ {
+			key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%d", i)
+			if i%100 == 0 {
+				val = strings.Repeat("x", 3*BTREE_PAGE_SIZE) // 溢出页
+			}
+			db.Set([]byte(key), []byte(val))
+			ref[key] = val
+		}
+		for i := 0; i < 3000; i++ {
+			if i%4 != 0 {
+				key := fmt.Sprintf("key%04d", i)
+				db.Del([]byte(key))
+				delete(ref, key)
+			}
+		}
+
+		path := filepath.Join(dir, "backup.db")
+		backupTo(t, db, path)
+		bak := openTestKV(t, path)
+		defer bak.Close()
+		verifyKV(t, bak, ref)
+		r := bak.Check()
+		if r.FreePages != 0 || r.FreeListPages != 1 {
+			t.Errorf("备份中的空闲链表应为空: %d 页, 链表 %d 页", r.FreePages, r.FreeListPages)
+		}
+		if r.Pages != uint64(2+r.TreePages+r.OverflowPages) {
+			t.Errorf("备份中有 %d 页, 树 %d 页, 溢出页 %d 页", r.Pages, r.TreePages, r.OverflowPages)
+		}
+		if fi, _ := os.Stat(path); fi.Size() != int64(r.Pages)*BTREE_PAGE_SIZE {
+			t.Errorf("文件大小 %d 与页数 %d 不一致", fi.Size(), r.Pages)
+		}
+		if r.Pages >= db.page.flushed {
+			t.Errorf("备份没有压缩: %d 页, 原文件 %d 页", r.Pages, db.page.flushed)
+		}
+		// 备份可以继续写入
+		bak.Set([]byte("new"), []byte("v"))
+		ref["new"] = "v"
+		verifyKV(t, bak, ref)
+	})
+
+	t.Run("空数据库", func(t *testing.T) {
+		dir := t.TempDir()
+		db := openTestKV(t, filepath.Join(dir, "test.db"))
+		defer db.Close()
+		path := filepath.Join(dir, "backup.db")
+		backupTo(t, db, path)
+		bak := openTestKV(t, path)
+		defer bak.Close()
+		verifyKV(t, bak, map[string]string{})
+	})
+
+	t.Run("保留文件格式", func(t *testing.T) {
+		dir := t.TempDir()
+		db := &KV{Path: filepath.Join(dir, "test.db"), PageSize: 16 << 10, PrefixCompression: true, NoChecksum: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		ref := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("common/prefix/key%04d", i)
+			db.Set([]byte(key), []byte(key))
+			ref[key] = key
+		}
+		path := filepath.Join(dir, "backup.db")
+		backupTo(t, db, path)
+		bak := openTestKV(t, path)
+		defer bak.Close()
+		if bak.PageSize != 16<<10 || !bak.PrefixCompression || bak.checksum {
+			t.Errorf("格式不同: 页大小 %d, 前缀压缩 %v, 校验和 %v", bak.PageSize, bak.PrefixCompression, bak.checksum)
+		}
+		verifyKV(t, bak, ref)
+	})
+
+	t.Run("不阻塞写入者", func(t *testing.T) {
+		dir := t.TempDir()
+		db := openTestKV(t, filepath.Join(dir, "test.db"))
+		defer db.Close()
+		for i := 0; i < 1000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("v"))
+		}
+		// 写入者按顺序写入键，任何一致的快照都恰好包含前若干个键
+		var stop atomic.Bool
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1000; !stop.Load(); i++ {
+				if err := db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		path := filepath.Join(dir, "backup.db")
+		backupTo(t, db, path)
+		stop.Store(true)
+		wg.Wait()
+
+		bak := openTestKV(t, path)
+		defer bak.Close()
+		n := 0
+		seq, errf := bak.tree.RangeErr(nil, nil)
+		for k := range seq {
+			if want := fmt.Sprintf("key%05d", n); string(k) != want {
+				t.Fatalf("第 %d 个键 %q, 期望 %q", n, k, want)
+			}
+			n++
+		}
+		if n < 1000 || errf() != nil {
+			t.Errorf("备份中只有 %d 个键: %v", n, errf())
+		}
+		if r := bak.Check(); !r.OK() {
+			t.Errorf("一致性检查: %v", r.Problems)
+		}
+	})
+
+	t.Run("页损坏", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+		db := openTestKV(t, path)
+		defer db.Close()
+		if err := db.Backup(&bytes.Buffer{}); !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+	})
+
+	t.Run("溢出页链表有环", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		db := &KV{Path: path, NoChecksum: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		db.Set([]byte("blob"), bytes.Repeat([]byte("x"), 3*BTREE_PAGE_SIZE))
+		// 只有一个键，根节点就是叶节点
+		ref := BNode(db.tree.get(db.tree.root)).getVal(1)
+		first := binary.LittleEndian.Uint64(ref[8:16])
+		last := first
+		for next := first; next != 0; next = binary.LittleEndian.Uint64(db.tree.get(next)[4:12]) {
+			last = next
+		}
+		db.Close()
+		fp, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], first)
+		fp.WriteAt(buf[:], int64(last)*BTREE_PAGE_SIZE+4)
+		fp.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if err := db.Backup(&bytes.Buffer{}); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("期望 ErrCorruptPage, 得到 %v", err)
+		}
+	})
+
+	t.Run("已关闭的数据库", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		db.Set([]byte("key"), []byte("val"))
+		db.Close()
+		if err := db.Backup(&bytes.Buffer{}); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("期望 ErrDBClosed, 得到 %v", err)
+		}
+	})
+}
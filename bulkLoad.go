@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// 从严格递增的键值对批量构建一棵空树，返回导入的键数
+// 叶节点按 fill 填充到节点大小的一定比例，取值 (0, 1]，然后自底向上逐层构建内部节点。
+// 每个页只通过 tree.new 写入一次，导入 n 个键只需要 O(n) 次页写入。
+// 出错时已经写入的页全部释放，树保持为空。
+func (tree *BTree) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	if tree.root != 0 {
+		return 0, ErrTreeNotEmpty
+	}
+	if !(fill > 0 && fill <= 1) {
+		return 0, fmt.Errorf("bad fill factor %v", fill)
+	}
+	b := &bulkBuilder{tree: tree, limit: max(int(fill*float64(tree.nodeSize())), HEADER)}
+	b.add(0, bulkKV{}) // 第一个叶节点的哨兵空键
+	count, err := 0, error(nil)
+	var prev []byte
+	for key, val := range kvs {
+		if err = checkKV(tree, key, val); err != nil {
+			break
+		}
+		if bytes.Compare(prev, key) >= 0 {
+			err = fmt.Errorf("%w: %q after %q", ErrUnsorted, key, prev)
+			break
+		}
+		kv := bulkKV{key: append([]byte(nil), key...)}
+		kv.val, kv.overflow = leafStoreVal(tree, val)
+		kv.val = append([]byte(nil), kv.val...)
+		b.add(0, kv)
+		prev = kv.key
+		count++
+	}
+	root := b.finish()
+	if err != nil {
+		// 释放失败时页可能只释放了一部分，两个错误一起返回
+		if _, ferr := treeFree(tree, root); ferr != nil {
+			err = errors.Join(err, ferr)
+		}
+		return 0, err
+	}
+	tree.root = root
+	return count, nil
+}
+
+// 批量构建时等待写入节点的一个键值对
+type bulkKV struct {
+	key      []byte
+	val      []byte
+	ptr      uint64
+	overflow bool
+}
+
+// 每一层正在填充的节点
+type bulkLevel struct {
+	kvs   []bulkKV
+	size  int // 写入这些键值对后节点的字节数
+	nodes int // 这一层已经写入的节点数
+}
+
+type bulkBuilder struct {
+	tree   *BTree
+	limit  int // 节点填充的字节数上限
+	levels []bulkLevel
+	last   []byte // 最后一个添加到叶节点的键
+}
+
+// 向第 level 层添加一个键值对，当前节点装不下时先写入它
+func (b *bulkBuilder) add(level int, kv bulkKV) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, bulkLevel{size: HEADER})
+	}
+	// 内部节点至少要有两个子节点，否则树的高度不会收敛
+	minKeys := 1
+	if level > 0 {
+		minKeys = 2
+	}
+	size := 8 + 2 + 4 + len(kv.key) + len(kv.val)
+	if len(b.levels[level].kvs) >= minKeys && b.sizeWith(level, kv.key)+size > b.limit {
+		b.flush(level)
+	}
+	lv := &b.levels[level]
+	lv.kvs = append(lv.kvs, kv)
+	lv.size += size
+	if level == 0 {
+		b.last = kv.key
+	}
+}
+
+// 加入 key 之后节点除 key 以外部分的字节数，前缀压缩时扣除每个键共享的前缀
+func (b *bulkBuilder) sizeWith(level int, key []byte) int {
+	lv := &b.levels[level]
+	if !b.tree.prefix {
+		return lv.size
+	}
+	if level > 0 {
+		return lv.size + 2 // 内部节点的前缀取决于之后的键，按不压缩估计
+	}
+	plen := len(commonPrefix(lv.kvs[0].key, key))
+	return lv.size + 2 + plen - (len(lv.kvs)+1)*plen
+}
+
+// 写入第 level 层正在填充的节点，并把指向它的链接添加到上一层
+func (b *bulkBuilder) flush(level int) {
+	ptr, key := b.write(level)
+	b.add(level+1, bulkKV{key: key, ptr: ptr})
+}
+
+// 把第 level 层正在填充的键值对写成一个节点
+func (b *bulkBuilder) write(level int) (uint64, []byte) {
+	lv := &b.levels[level]
+	btype := uint16(BNODE_NODE)
+	if level == 0 {
+		btype = BNODE_LEAF
+	}
+	var prefix []byte
+	if b.tree.prefix {
+		// 叶节点取首尾两个键的共同前缀，内部节点还要覆盖最后一棵子树中的键
+		last := lv.kvs[len(lv.kvs)-1].key
+		if level > 0 {
+			last = b.last
+		}
+		prefix = append([]byte{}, commonPrefix(lv.kvs[0].key, last)...)
+	}
+	node := BNode(make([]byte, b.tree.pageSize()))
+	node.setHeaderPrefix(btype, uint16(len(lv.kvs)), prefix)
+	for i, kv := range lv.kvs {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+		if kv.overflow {
+			node.setOverflow(uint16(i))
+		}
+	}
+	key := lv.kvs[0].key
+	lv.kvs, lv.size = nil, HEADER
+	lv.nodes++
+	return b.tree.new(node), key
+}
+
+// 自底向上写入所有剩下的节点，返回根节点
+func (b *bulkBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		if level == len(b.levels)-1 && b.levels[level].nodes == 0 {
+			// 最高层只有这一个节点，它就是根节点
+			ptr, _ := b.write(level)
+			return ptr
+		}
+		b.flush(level)
+	}
+}
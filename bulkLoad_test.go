@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 按顺序产生 n 个键值对 key000000 ...，值的大小由 vsize 决定
+func sortedKVs(n int, vsize func(i int) int) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			if !yield([]byte(key), []byte(strings.Repeat("v", vsize(i)))) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		fill float64
+	}{{0, 1}, {1, 1}, {100, 1}, {20000, 1}, {20000, 0.5}, {3000, 0.01}} {
+		t.Run(fmt.Sprintf("n=%d,fill=%v", tc.n, tc.fill), func(t *testing.T) {
+			c := newC()
+			vsize := func(i int) int { return i % 100 }
+			count, err := c.tree.BulkLoad(sortedKVs(tc.n, vsize), tc.fill)
+			if err != nil || count != tc.n {
+				t.Fatalf("导入错误: %d %v", count, err)
+			}
+			for key, val := range sortedKVs(tc.n, vsize) {
+				c.ref[string(key)] = string(val)
+			}
+			c.verify(t)
+			// 导入后的树可以正常修改
+			c.add("key000050x", "new")
+			c.tree.Delete([]byte("key000001"))
+			delete(c.ref, "key000001")
+			c.verify(t)
+		})
+	}
+
+	t.Run("页数接近最少", func(t *testing.T) {
+		bulk, ins := newC(), newC()
+		if _, err := bulk.tree.BulkLoad(sortedKVs(20000, func(int) int { return 50 }), 1); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range sortedKVs(20000, func(int) int { return 50 }) {
+			ins.tree.Insert(key, val)
+		}
+		if len(bulk.pages) >= len(ins.pages) {
+			t.Errorf("批量导入的页数 %d 应少于逐个插入的 %d", len(bulk.pages), len(ins.pages))
+		}
+		leaves := 0
+		for _, node := range bulk.pages {
+			if node.btype() == BNODE_LEAF {
+				leaves++
+			}
+		}
+		// 每个键值对占 14+9+50 字节
+		if want := 20000*73/BTREE_PAGE_SIZE + 2; leaves > want {
+			t.Errorf("叶节点太多: %d > %d", leaves, want)
+		}
+	})
+
+	t.Run("前缀压缩", func(t *testing.T) {
+		kvs := func(yield func([]byte, []byte) bool) {
+			for i := 0; i < 20000; i++ {
+				if !yield([]byte(prefixKey(i/1000, i%1000)), []byte("v")) {
+					return
+				}
+			}
+		}
+		plain, c := newC(), newC()
+		c.tree.prefix = true
+		if _, err := plain.tree.BulkLoad(kvs, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.tree.BulkLoad(kvs, 1); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range kvs {
+			c.ref[string(key)] = string(val)
+		}
+		c.verify(t)
+		if len(c.pages)*2 > len(plain.pages) {
+			t.Errorf("前缀压缩后的页数 %d 应不到原来 %d 的一半", len(c.pages), len(plain.pages))
+		}
+		// 导入后插入的键可能不共享节点的前缀
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			key := prefixKey(rng.Intn(25), rng.Intn(1200)) + strings.Repeat("x", rng.Intn(3))
+			c.add(key, "new")
+			if i%2 == 0 {
+				key = prefixKey(rng.Intn(25), rng.Intn(1200))
+				c.tree.Delete([]byte(key))
+				delete(c.ref, key)
+			}
+		}
+		c.verify(t)
+	})
+
+	t.Run("大值", func(t *testing.T) {
+		c := newC()
+		vsize := func(i int) int { return i * 1000 }
+		if _, err := c.tree.BulkLoad(sortedKVs(20, vsize), 1); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range sortedKVs(20, vsize) {
+			c.ref[string(key)] = string(val)
+		}
+		c.verify(t)
+	})
+
+	t.Run("错误", func(t *testing.T) {
+		unsorted := func(yield func([]byte, []byte) bool) {
+			for _, key := range []string{"a", "c", "c"} {
+				if !yield([]byte(key), []byte(strings.Repeat("v", 5000))) {
+					return
+				}
+			}
+		}
+		c := newC()
+		if _, err := c.tree.BulkLoad(unsorted, 1); !errors.Is(err, ErrUnsorted) {
+			t.Errorf("期望 ErrUnsorted, 得到 %v", err)
+		}
+		if c.tree.root != 0 || len(c.pages) != 0 {
+			t.Errorf("出错后应释放所有页: 剩下 %d 页", len(c.pages))
+		}
+		// 释放已写入的页失败时同样返回释放的错误
+		c.tree.check = func(uint64) error { return ErrChecksum }
+		if _, err := c.tree.BulkLoad(unsorted, 1); !errors.Is(err, ErrUnsorted) || !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrUnsorted 和 ErrChecksum, 得到 %v", err)
+		}
+		c = newC()
+		for _, fill := range []float64{0, -1, 1.5} {
+			if _, err := c.tree.BulkLoad(sortedKVs(1, func(int) int { return 1 }), fill); err == nil {
+				t.Errorf("填充比例 %v 应被拒绝", fill)
+			}
+		}
+		c.add("k", "v")
+		if _, err := c.tree.BulkLoad(sortedKVs(1, func(int) int { return 1 }), 1); !errors.Is(err, ErrTreeNotEmpty) {
+			t.Errorf("期望 ErrTreeNotEmpty, 得到 %v", err)
+		}
+	})
+
+	t.Run("持久化", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		vsize := func(i int) int { return i % 200 }
+		if count, err := db.BulkLoad(sortedKVs(50000, vsize), 0.9); err != nil || count != 50000 {
+			t.Fatalf("导入错误: %d %v", count, err)
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		for key, val := range sortedKVs(50000, vsize) {
+			if got, found, _ := db.Get(key); !found || string(got) != string(val) {
+				t.Fatalf("键 %q 错误", key)
+			}
+		}
+		if _, err := db.BulkLoad(sortedKVs(1, vsize), 1); !errors.Is(err, ErrTreeNotEmpty) {
+			t.Errorf("期望 ErrTreeNotEmpty, 得到 %v", err)
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// 一致性检查发现的一个问题
+type CheckProblem struct {
+	Page uint64 // 出问题的页，0 表示元数据页
+	Msg  string
+}
+
+func (p CheckProblem) String() string {
+	return fmt.Sprintf("page %d: %s", p.Page, p.Msg)
+}
+
+// 一致性检查的结果
+type CheckReport struct {
+	Pages         uint64 // 元数据页中记录的已使用的页数，包括元数据页
+	TreePages     int    // 树中的节点数
+	OverflowPages int    // 溢出页数
+	FreeListPages int    // 空闲链表自身的节点数
+	FreePages     int    // 空闲链表中的页数
+	Keys          int    // 键的数量，不含哨兵
+	Height        int    // 树的高度，空树为 0
+	Problems      []CheckProblem
+}
+
+// 没有发现任何问题
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// 检查整个数据库文件的一致性，发现的问题记录在报告中而不是 panic：
+//   - 节点的类型、布局合法，大小不超过节点的上限，校验和正确
+//   - 节点内和节点之间的键严格递增，内部节点的第 i 个键等于第 i 个子节点的第一个键
+//   - 所有叶节点深度相同，溢出页链表完整
+//   - 每一页恰好被树或空闲链表引用一次，两者没有重叠，也没有泄漏的页
+//
+// 检查期间阻塞写事务，读事务不受影响
+func (db *KV) Check() *CheckReport {
+	return &db.check().report
+}
+
+// 执行一致性检查，返回的 checker 中还记录了每一页被谁引用
+func (db *KV) check() *checker {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	c := &checker{db: db, owner: make([]string, db.page.flushed), leafDepth: -1}
+	c.report.Pages = db.page.flushed
+	if db.tree.root != 0 {
+		c.walk(db.tree.root, []byte{}, nil, 1)
+	}
+	c.walkFreeList()
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if c.owner[ptr] == "" {
+			c.problem(ptr, "page is neither in the tree nor in the free list")
+		}
+	}
+	return c
+}
+
+type checker struct {
+	db        *KV
+	report    CheckReport
+	owner     []string // 每一页被谁引用：tree、overflow、free list 或 free，空表示没有被引用
+	leafDepth int
+}
+
+func (c *checker) problem(ptr uint64, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, CheckProblem{ptr, fmt.Sprintf(format, args...)})
+}
+
+// 记录 ptr 被 owner 引用，页号越界或者重复引用时返回 false
+func (c *checker) mark(ptr uint64, owner string) bool {
+	if ptr == 0 || ptr >= uint64(len(c.owner)) {
+		c.problem(ptr, "%s page out of range (%d pages)", owner, len(c.owner))
+		return false
+	}
+	if c.owner[ptr] != "" {
+		c.problem(ptr, "page referenced twice: as %s and as %s", c.owner[ptr], owner)
+		return false
+	}
+	c.owner[ptr] = owner
+	return true
+}
+
+// 读取一页，读取失败或者校验和不一致时返回 nil
+func (c *checker) read(ptr uint64) []byte {
+	return c.readPage(ptr, c.db.checksum)
+}
+
+// 与 read 相同，verify 为 false 时不检查校验和
+// 新建的文件在第一次提交之前，空闲链表的第一个节点只在内存中
+func (c *checker) readPage(ptr uint64, verify bool) []byte {
+	if _, ok := c.db.page.updates[ptr]; ok {
+		return c.db.pageRead(ptr)
+	}
+	page, err := pageReadFile(c.db, ptr)
+	if err == nil && verify {
+		err = pageVerify(page, ptr)
+	}
+	if err != nil {
+		c.problem(ptr, "%v", err)
+		return nil
+	}
+	return page[c.db.pageHeader():]
+}
+
+// 检查以 ptr 为根的子树，子树的第一个键必须等于 first，所有的键小于 upper
+func (c *checker) walk(ptr uint64, first []byte, upper []byte, depth int) {
+	if !c.mark(ptr, "tree") {
+		return
+	}
+	c.report.TreePages++
+	c.report.Height = max(c.report.Height, depth)
+	page := c.read(ptr)
+	if page == nil {
+		return
+	}
+	node := BNode(page)
+	if err := checkNodeLayout(node, c.db.tree.nodeSize()); err != nil {
+		c.problem(ptr, "%v", err)
+		return
+	}
+	if node.nkeys() == 0 {
+		c.problem(ptr, "empty node")
+		return
+	}
+	if key := node.getKey(0); !bytes.Equal(key, first) {
+		c.problem(ptr, "first key %q differs from the separator %q in the parent", key, first)
+	}
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			c.problem(ptr, "keys not sorted at index %d", i)
+		}
+	}
+	if last := node.getKey(node.nkeys() - 1); upper != nil && bytes.Compare(last, upper) >= 0 {
+		c.problem(ptr, "key %q not less than the next separator %q", last, upper)
+	}
+
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kidUpper := upper
+			if i+1 < node.nkeys() {
+				kidUpper = node.getKey(i + 1)
+			}
+			c.walk(node.getPtr(i), node.getKey(i), kidUpper, depth+1)
+		}
+		return
+	}
+	if c.leafDepth >= 0 && c.leafDepth != depth {
+		c.problem(ptr, "leaf at depth %d, other leaves at depth %d", depth, c.leafDepth)
+	}
+	c.leafDepth = depth
+	c.report.Keys += int(node.nkeys())
+	if len(first) == 0 {
+		c.report.Keys-- // 哨兵
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.isOverflow(i) {
+			c.walkOverflow(ptr, node.getVal(i))
+		}
+	}
+}
+
+// 检查叶节点 leaf 中的一个溢出引用指向的链表
+func (c *checker) walkOverflow(leaf uint64, ref []byte) {
+	total := binary.LittleEndian.Uint64(ref[0:8])
+	size := uint64(0)
+	for ptr := binary.LittleEndian.Uint64(ref[8:16]); ptr != 0; {
+		if !c.mark(ptr, "overflow") {
+			return
+		}
+		c.report.OverflowPages++
+		page := c.read(ptr)
+		if page == nil {
+			return
+		}
+		if t := binary.LittleEndian.Uint16(page[0:2]); t != BNODE_OVERFLOW {
+			c.problem(ptr, "bad overflow page type %d", t)
+			return
+		}
+		n := binary.LittleEndian.Uint16(page[2:4])
+		if int(n) > overflowCap(len(page)) {
+			c.problem(ptr, "overflow page size %d too large", n)
+			return
+		}
+		size += uint64(n)
+		ptr = binary.LittleEndian.Uint64(page[4:12])
+	}
+	if size != total {
+		c.problem(leaf, "overflow value has %d bytes, expected %d", size, total)
+	}
+}
+
+// 检查空闲链表，链表节点和其中的页都不能与树重叠
+func (c *checker) walkFreeList() {
+	fl := &c.db.free
+	if fl.headSeq > fl.tailSeq {
+		c.problem(0, "free list head %d after tail %d", fl.headSeq, fl.tailSeq)
+		return
+	}
+	ptr, seq := fl.headPage, fl.headSeq
+	for {
+		if !c.mark(ptr, "free list") {
+			return
+		}
+		c.report.FreeListPages++
+		// 尾节点是原地修改的，崩溃时可能只写入了一部分，与 KV.freeRead 一样不校验
+		page := c.readPage(ptr, c.db.checksum && ptr != fl.tailPage)
+		if page == nil {
+			return
+		}
+		node := LNode(page)
+		// 这个节点中剩下的项
+		end := seq + uint64(freeListCap(fl.pageSize())-fl.seq2idx(seq))
+		for ; seq < min(end, fl.tailSeq); seq++ {
+			if c.mark(node.getPtr(fl.seq2idx(seq)), "free") {
+				c.report.FreePages++
+			}
+		}
+		if ptr == fl.tailPage {
+			if seq != fl.tailSeq {
+				c.problem(ptr, "free list ends with %d items left", fl.tailSeq-seq)
+			}
+			return
+		}
+		if ptr = node.getNext(); ptr == 0 {
+			c.problem(0, "free list ends before the tail page %d", fl.tailPage)
+			return
+		}
+	}
+}
+
+// 检查节点的布局，保证之后读取键值对不会越界
+func checkNodeLayout(node BNode, nodeSize int) error {
+	if err := checkNodeType(node); err != nil {
+		return err
+	}
+	n := int(node.nkeys())
+	start := int(node.hsize()) + 10*n // 键值对开始的位置
+	if start > len(node) {
+		return fmt.Errorf("%w: %d keys do not fit in a page", ErrCorruptPage, n)
+	}
+	for i := 0; i < n; i++ {
+		pos := start + int(node.getOffset(uint16(i)))
+		if pos+4 > len(node) {
+			return fmt.Errorf("%w: key %d out of the page", ErrCorruptPage, i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := binary.LittleEndian.Uint16(node[pos+2:])
+		overflow := vlen&VAL_OVERFLOW != 0
+		end := pos + 4 + klen + int(vlen&^VAL_OVERFLOW)
+		if end > len(node) || end != start+int(node.getOffset(uint16(i+1))) {
+			return fmt.Errorf("%w: bad offset of key %d", ErrCorruptPage, i)
+		}
+		if overflow && (node.btype() != BNODE_LEAF || vlen&^VAL_OVERFLOW != OVERFLOW_REF_SIZE) {
+			return fmt.Errorf("%w: bad overflow reference at key %d", ErrCorruptPage, i)
+		}
+	}
+	if int(node.nbytes()) > nodeSize {
+		return fmt.Errorf("%w: node has %d bytes, limit %d", ErrCorruptPage, node.nbytes(), nodeSize)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 报告中是否有页 ptr 上包含 msg 的问题
+func hasProblem(r *CheckReport, ptr uint64, msg string) bool {
+	for _, p := range r.Problems {
+		if p.Page == ptr && strings.Contains(p.Msg, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("正常的文件", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		if r := db.Check(); !r.OK() || r.Keys != 0 || r.Height != 0 {
+			t.Fatalf("空数据库: %+v", r)
+		}
+		for i := 0; i < 3000; i++ {
+			val := strings.Repeat("v", i%100)
+			if i%500 == 0 {
+				val = strings.Repeat("o", 3*BTREE_PAGE_SIZE)
+			}
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(val))
+		}
+		db.DeleteRange([]byte("key1000"), []byte("key2000"))
+		r := db.Check()
+		if !r.OK() {
+			t.Fatalf("不应有问题: %v", r.Problems)
+		}
+		if r.Keys != 2000 || r.Height < 2 || r.OverflowPages == 0 || r.FreePages == 0 {
+			t.Errorf("统计错误: %+v", r)
+		}
+		if total := r.TreePages + r.OverflowPages + r.FreeListPages + r.FreePages; uint64(total) != r.Pages-1 {
+			t.Errorf("页数不一致: %d + %d + %d + %d != %d", r.TreePages, r.OverflowPages, r.FreeListPages, r.FreePages, r.Pages-1)
+		}
+	})
+
+	t.Run("校验和错误", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+		db := openTestKV(t, path)
+		defer db.Close()
+		if r := db.Check(); !hasProblem(r, ptr, "checksum mismatch") {
+			t.Errorf("应发现页 %d 的校验和错误: %v", ptr, r.Problems)
+		}
+	})
+
+	t.Run("键没有排序", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, NoChecksum: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v"))
+		}
+		// 把一个叶节点中的两个键交换位置
+		root := BNode(db.tree.get(db.tree.root))
+		ptr := root.getPtr(1)
+		leaf := BNode(db.tree.get(ptr))
+		bad := BNode(make([]byte, BTREE_PAGE_SIZE))
+		bad.setHeader(BNODE_LEAF, leaf.nkeys())
+		nodeAppendRange(bad, leaf, 0, 0, leaf.nkeys())
+		nodeAppendKV(bad, 1, 0, leaf.getKey(2), leaf.getVal(2))
+		nodeAppendKV(bad, 2, 0, leaf.getKey(1), leaf.getVal(1))
+		db.Close()
+		fp, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.WriteAt(bad, int64(ptr)*BTREE_PAGE_SIZE)
+		fp.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if r := db.Check(); !hasProblem(r, ptr, "keys not sorted") {
+			t.Errorf("应发现页 %d 中的键没有排序: %v", ptr, r.Problems)
+		}
+	})
+
+	t.Run("页的引用错误", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		for i := 0; i < 1000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v"))
+		}
+		db.DeleteRange([]byte("key0100"), []byte("key0900"))
+
+		// 取出一个空闲页但不使用它
+		tx, _ := db.Begin(false)
+		leaked := db.free.PopHead()
+		tx.tree.Insert([]byte("k"), []byte("v"))
+		tx.Commit()
+		r := db.Check()
+		if leaked == 0 || !hasProblem(r, leaked, "neither in the tree nor in the free list") {
+			t.Errorf("应发现泄漏的页 %d: %v", leaked, r.Problems)
+		}
+
+		// 把树中的页放入空闲链表
+		tx, _ = db.Begin(false)
+		root := db.tree.root
+		db.free.PushTail(root)
+		tx.Commit()
+		r = db.Check()
+		if !hasProblem(r, root, "referenced twice") {
+			t.Errorf("应发现页 %d 被重复引用: %v", root, r.Problems)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+)
+
+// 页校验和
+//
+// 使用校验和的文件中，除元数据页以外的每一页都以 4 字节的 CRC32C 开头：
+// | checksum | payload |
+// |    4B    |   ...   |
+// B+树节点、溢出页和空闲链表节点都保存在 payload 中，可用的页大小相应减少 4 字节。
+// 校验和覆盖页号和 payload，写错位置的页同样能被发现。
+// 校验和在写入文件之前计算，每次通过 tree.get 读取文件中的页时校验。
+const PAGE_CHECKSUM_SIZE = 4
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// 页号为 ptr 的页的校验和
+func pageChecksum(page []byte, ptr uint64) uint32 {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], ptr)
+	crc := crc32.Update(0, crc32c, buf[:])
+	return crc32.Update(crc, crc32c, page[PAGE_CHECKSUM_SIZE:])
+}
+
+// 写入文件之前设置页头的校验和
+func pageSetChecksum(page []byte, ptr uint64) {
+	binary.LittleEndian.PutUint32(page[0:4], pageChecksum(page, ptr))
+}
+
+// 检查页头的校验和
+func pageVerify(page []byte, ptr uint64) error {
+	stored := binary.LittleEndian.Uint32(page[0:4])
+	if actual := pageChecksum(page, ptr); stored != actual {
+		return fmt.Errorf("%w: stored %08x, computed %08x", ErrChecksum, stored, actual)
+	}
+	return nil
+}
+
+// 读到校验和不一致的页时的处理方式
+type CorruptPolicy int
+
+const (
+	// 返回包含页号的 ErrChecksum 错误，迭代器的错误通过 BIter.Err 取得
+	CORRUPT_ERROR CorruptPolicy = iota
+	CORRUPT_PANIC               // 总是 panic
+	CORRUPT_LOG                 // 记录日志之后继续使用这个页
+)
+
+// 按 db.OnCorrupt 处理校验失败的页，返回 nil 表示继续使用这个页
+func (db *KV) onCorrupt(ptr uint64, err error) error {
+	switch db.OnCorrupt {
+	case CORRUPT_PANIC:
+		panic(fmt.Errorf("page %d: %w", ptr, err))
+	case CORRUPT_LOG:
+		log.Printf("%s: page %d: %v", db.Path, ptr, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// 校验从 chunks 中读取的页，本次更新中还没有写入文件的页不需要校验
+// 使用页缓存时，页在读入缓存时校验，这里同时返回读取的错误；
+// 没有返回错误时页被 pin 住，读取者用完之后通过 tree.unpin 释放
+func (db *KV) pageCheck(chunks [][]byte, ptr uint64) error {
+	if db.pager != nil {
+		_, err := db.pager.pin(ptr)
+		if errors.Is(err, ErrChecksum) {
+			if db.OnCorrupt != CORRUPT_LOG {
+				db.pager.unpin(ptr) // 只有记录日志时才继续使用这一页
+			}
+			return db.onCorrupt(ptr, err)
+		}
+		return err
+	}
+	if !db.checksum {
+		return nil
+	}
+	if err := pageVerify(mmapRead(chunks, ptr, db.PageSize), ptr); err != nil {
+		return db.onCorrupt(ptr, err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 写入一些键，返回存放 key 的叶节点的页号
+func writeChecksumDB(t *testing.T, path string, key string) uint64 {
+	t.Helper()
+	db := openTestKV(t, path)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(strings.Repeat("v", 50))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ptr := db.tree.root
+	for {
+		node := BNode(db.tree.get(ptr))
+		if node.btype() == BNODE_LEAF {
+			return ptr
+		}
+		ptr = node.getPtr(nodeLookupLE(node, []byte(key)))
+	}
+}
+
+// 翻转文件中第 ptr 页的一个比特
+func flipBit(t *testing.T, path string, ptr uint64) {
+	t.Helper()
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var b [1]byte
+	off := int64(ptr)*BTREE_PAGE_SIZE + 100
+	fp.ReadAt(b[:], off)
+	b[0] ^= 0x10
+	if _, err := fp.WriteAt(b[:], off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Run("计算和校验", func(t *testing.T) {
+		page := make([]byte, BTREE_PAGE_SIZE)
+		copy(page[PAGE_CHECKSUM_SIZE:], "hello")
+		pageSetChecksum(page, 7)
+		if err := pageVerify(page, 7); err != nil {
+			t.Fatal(err)
+		}
+		if err := pageVerify(page, 8); !errors.Is(err, ErrChecksum) {
+			t.Errorf("页号不同时应校验失败: %v", err)
+		}
+		page[BTREE_PAGE_SIZE-1] ^= 1
+		if err := pageVerify(page, 7); !errors.Is(err, ErrChecksum) || !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+	})
+
+	t.Run("页头占用的空间", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		if db.tree.nodeSize() != BTREE_PAGE_SIZE-PAGE_CHECKSUM_SIZE {
+			t.Errorf("节点大小错误: %d", db.tree.nodeSize())
+		}
+		// 键值对的上限不变
+		big := make([]byte, BTREE_MAX_KEY_SIZE)
+		big[0] = 'k'
+		if err := db.Set(big, make([]byte, BTREE_MAX_VAL_SIZE)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set(append(big, 'x'), nil); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("期望 ErrKeyTooLarge, 得到 %v", err)
+		}
+	})
+
+	t.Run("返回错误", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+
+		db := openTestKV(t, path)
+		defer db.Close()
+		err := db.Set([]byte("key0500"), []byte("new"))
+		if !errors.Is(err, ErrChecksum) || !strings.Contains(err.Error(), fmt.Sprintf("page %d", ptr)) {
+			t.Fatalf("期望带有页号 %d 的 ErrChecksum, 得到 %v", ptr, err)
+		}
+		if _, err := db.Del([]byte("key0500")); !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+		// 其他页不受影响
+		if val, found, _ := db.Get([]byte("key0000")); !found || len(val) != 50 {
+			t.Error("其他页中的键应能正常读取")
+		}
+		// 读取路径同样返回错误
+		if _, _, err := db.Get([]byte("key0500")); !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+		tx, _ := db.Begin(true)
+		defer tx.Abort()
+		n := 0
+		seq, errf := tx.RangeErr(nil, nil)
+		for range seq {
+			n++
+		}
+		if err := errf(); !errors.Is(err, ErrChecksum) || n >= 1000 {
+			t.Errorf("遍历了 %d 个键, 期望 ErrChecksum, 得到 %v", n, err)
+		}
+		iter := tx.SeekGE([]byte("key0500"))
+		if iter.Valid() || !errors.Is(iter.Err(), ErrChecksum) {
+			t.Errorf("迭代器期望 ErrChecksum, 得到 %v", iter.Err())
+		}
+	})
+
+	t.Run("空闲链表损坏", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		writeChecksumDB(t, path, "")
+		db := openTestKV(t, path)
+		// 释放足够多的页，使头节点不是尾节点，尾节点读取时不校验
+		db.Set([]byte("big"), make([]byte, 4<<20))
+		db.Del([]byte("big"))
+		head := db.free.headPage
+		if head == db.free.tailPage {
+			t.Fatal("空闲链表只有一个节点")
+		}
+		db.Close()
+		flipBit(t, path, head)
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if err := db.Set([]byte("key0000"), []byte("new")); !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+		// 失败的更新整个回滚
+		if val, _, err := db.Get([]byte("key0000")); err != nil || len(val) != 50 {
+			t.Errorf("读取错误: %q %v", val, err)
+		}
+	})
+
+	t.Run("空闲链表的尾节点没有写完", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		writeChecksumDB(t, path, "")
+		db := openTestKV(t, path)
+		tail, idx := db.free.tailPage, db.free.seq2idx(db.free.tailSeq)
+		db.Close()
+		// 模拟崩溃时没有写完的原地修改：已提交的项之后的位置变了，校验和没有更新
+		fp, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := int64(tail)*BTREE_PAGE_SIZE + PAGE_CHECKSUM_SIZE + FREE_LIST_HEADER + 8*int64(idx)
+		fp.WriteAt([]byte{0x55}, off)
+		fp.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if r := db.Check(); !r.OK() {
+			t.Errorf("一致性检查: %v", r.Problems)
+		}
+		// 更新从尾节点加入释放的页，也从中取出页
+		for i := 0; i < 1000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if val, _, err := db.Get([]byte("key0999")); err != nil || string(val) != "new" {
+			t.Errorf("读取错误: %q %v", val, err)
+		}
+		if r := db.Check(); !r.OK() {
+			t.Errorf("一致性检查: %v", r.Problems)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+
+		db := &KV{Path: path, OnCorrupt: CORRUPT_PANIC}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrChecksum) {
+				t.Errorf("期望 ErrChecksum 的 panic, 得到 %v", err)
+			}
+		}()
+		db.Set([]byte("key0500"), []byte("new"))
+		t.Error("应该 panic")
+	})
+
+	t.Run("记录日志", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+		db := &KV{Path: path, OnCorrupt: CORRUPT_LOG}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		// 翻转的比特在未使用的空间中，页仍然可以使用
+		if _, found, _ := db.Get([]byte("key0500")); !found {
+			t.Error("应继续使用这个页")
+		}
+		if err := db.Set([]byte("key0500"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), fmt.Sprintf("page %d", ptr)) {
+			t.Errorf("日志中应有页号 %d: %q", ptr, buf.String())
+		}
+	})
+
+	t.Run("不使用校验和", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, NoChecksum: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v"))
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if db.checksum {
+			t.Error("应使用文件中记录的格式")
+		}
+		if db.tree.nodeSize() != BTREE_PAGE_SIZE {
+			t.Errorf("没有页头时节点使用整个页: %d", db.tree.nodeSize())
+		}
+		if val, found, _ := db.Get([]byte("key0999")); !found || string(val) != "v" {
+			t.Error("读取错误")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 输出中键和值显示的最大字节数
+const dumpMaxBytes = 64
+
+// 显示键或值：可打印的 UTF-8 加引号显示，否则显示十六进制，过长时截断
+func fmtBytes(b []byte) string {
+	s, more := b, ""
+	if len(s) > dumpMaxBytes {
+		s, more = s[:dumpMaxBytes], fmt.Sprintf("... (%d bytes)", len(b))
+	}
+	printable := utf8.Valid(s)
+	for _, r := range string(s) {
+		if !printable || !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		return strconv.Quote(string(s)) + more
+	}
+	return "0x" + hex.EncodeToString(s) + more
+}
+
+// 按页的用途解码并输出一页，owner 是一致性检查得到的每一页的用途，见 checker.owner
+// 只输出已经写入文件的页，新建的文件在第一次提交之前一页也没有
+func dumpPage(w io.Writer, db *KV, owner []string, ptr uint64) error {
+	npages := min(db.page.flushed, uint64(db.mmap.file/db.PageSize))
+	if ptr >= npages {
+		return fmt.Errorf("page %d out of range (%d pages)", ptr, npages)
+	}
+	page, err := pageReadFile(db, ptr)
+	if err != nil {
+		return err
+	}
+	if ptr == 0 {
+		dumpMeta(w, page)
+		return nil
+	}
+	use := owner[ptr]
+	if use == "" {
+		use = "unreferenced"
+	}
+	fmt.Fprintf(w, "page %d: %s\n", ptr, use)
+	if db.checksum {
+		if err := pageVerify(page, ptr); err != nil {
+			fmt.Fprintf(w, "checksum: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "checksum: ok\n")
+		}
+	}
+	page = page[db.pageHeader():]
+	switch use {
+	case "tree":
+		dumpNode(w, BNode(page), db.tree.nodeSize())
+	case "overflow":
+		dumpOverflow(w, page)
+	case "free list":
+		dumpFreeList(w, LNode(page))
+	default:
+		// 空闲的页或泄漏的页，内容没有意义，只显示开头
+		fmt.Fprintf(w, "data: %s\n", fmtBytes(page))
+	}
+	return nil
+}
+
+func dumpMeta(w io.Writer, data []byte) {
+	flags := binary.LittleEndian.Uint64(data[72:])
+	fmt.Fprintf(w, "page 0: meta\n")
+	fmt.Fprintf(w, "signature: %s\n", fmtBytes(data[0:16]))
+	fmt.Fprintf(w, "version: %d\n", binary.LittleEndian.Uint32(data[16:]))
+	fmt.Fprintf(w, "page size: %d\n", binary.LittleEndian.Uint32(data[20:]))
+	fmt.Fprintf(w, "root: %d\n", binary.LittleEndian.Uint64(data[24:]))
+	fmt.Fprintf(w, "pages: %d\n", binary.LittleEndian.Uint64(data[32:]))
+	fmt.Fprintf(w, "free list: head page %d seq %d, tail page %d seq %d\n",
+		binary.LittleEndian.Uint64(data[40:]), binary.LittleEndian.Uint64(data[48:]),
+		binary.LittleEndian.Uint64(data[56:]), binary.LittleEndian.Uint64(data[64:]))
+	fmt.Fprintf(w, "flags: %#x prefix=%t checksum=%t\n",
+		flags, flags&META_FLAG_PREFIX != 0, flags&META_FLAG_CHECKSUM != 0)
+}
+
+// 输出 B+树节点的头部、指针、偏移量和键值对
+func dumpNode(w io.Writer, node BNode, nodeSize int) {
+	if err := checkNodeLayout(node, nodeSize); err != nil {
+		fmt.Fprintf(w, "bad node: %v\n", err)
+		fmt.Fprintf(w, "data: %s\n", fmtBytes(node))
+		return
+	}
+	kind := "leaf"
+	if node.btype() == BNODE_NODE {
+		kind = "internal"
+	}
+	fmt.Fprintf(w, "type: %s, keys: %d, bytes: %d\n", kind, node.nkeys(), node.nbytes())
+	if prefix := node.prefix(); prefix != nil {
+		fmt.Fprintf(w, "prefix: %s\n", fmtBytes(prefix))
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		fmt.Fprintf(w, "%4d offset %-5d key %s", i, node.getOffset(i), fmtBytes(node.getKey(i)))
+		switch {
+		case node.btype() == BNODE_NODE:
+			fmt.Fprintf(w, " -> page %d\n", node.getPtr(i))
+		case node.isOverflow(i):
+			ref := node.getVal(i)
+			fmt.Fprintf(w, " val overflow %d bytes at page %d\n",
+				binary.LittleEndian.Uint64(ref[0:8]), binary.LittleEndian.Uint64(ref[8:16]))
+		default:
+			fmt.Fprintf(w, " val %s\n", fmtBytes(node.getVal(i)))
+		}
+	}
+}
+
+func dumpOverflow(w io.Writer, page []byte) {
+	size := int(binary.LittleEndian.Uint16(page[2:4]))
+	fmt.Fprintf(w, "type: %d, size: %d, next: %d\n",
+		binary.LittleEndian.Uint16(page[0:2]), size, binary.LittleEndian.Uint64(page[4:12]))
+	fmt.Fprintf(w, "data: %s\n", fmtBytes(page[OVERFLOW_HEADER:][:min(size, overflowCap(len(page)))]))
+}
+
+// 链表节点是循环使用的，其中可能还留有已经取出的页号
+func dumpFreeList(w io.Writer, node LNode) {
+	fmt.Fprintf(w, "next: %d\n", node.getNext())
+	var ptrs []string
+	for i := 0; i < freeListCap(len(node)); i++ {
+		if ptr := node.getPtr(i); ptr != 0 {
+			ptrs = append(ptrs, fmt.Sprintf("%d:%d", i, ptr))
+		}
+	}
+	fmt.Fprintf(w, "slots: %s\n", strings.Join(ptrs, " "))
+}
+
+// 按缩进输出树的结构，读不出的节点输出错误之后跳过
+func dumpTree(w io.Writer, tree *BTree) {
+	if tree.root == 0 {
+		fmt.Fprintln(w, "empty tree")
+		return
+	}
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		indent := strings.Repeat("  ", depth)
+		node, err := treeLoad(tree, ptr)
+		if err == nil {
+			defer treeUnpin(tree, ptr)
+			err = checkNodeLayout(node, tree.nodeSize())
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s%v\n", indent, err)
+			return
+		}
+		fmt.Fprintf(w, "%s%s\n", indent, nodeSummary(ptr, node, tree.nodeSize()))
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i), depth+1)
+			}
+		}
+	}
+	walk(tree.root, 0)
+}
+
+// 一个节点的概要：页号、类型、键的数量、填充率和键的范围
+func nodeSummary(ptr uint64, node BNode, nodeSize int) string {
+	kind := "leaf"
+	if node.btype() == BNODE_NODE {
+		kind = "internal"
+	}
+	return fmt.Sprintf("page %d: %s, %d keys, %d%% full, %s .. %s", ptr, kind, node.nkeys(),
+		100*int(node.nbytes())/nodeSize, fmtBytes(node.getKey(0)), fmtBytes(node.getKey(node.nkeys()-1)))
+}
+
+// 以 Graphviz DOT 的格式输出树的结构
+func dumpTreeDot(w io.Writer, tree *BTree) {
+	fmt.Fprintln(w, "digraph btree {")
+	fmt.Fprintln(w, "  node [shape=box];")
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node, err := treeLoad(tree, ptr)
+		if err == nil {
+			defer treeUnpin(tree, ptr)
+			err = checkNodeLayout(node, tree.nodeSize())
+		}
+		if err != nil {
+			fmt.Fprintf(w, "  p%d [label=%s, color=red];\n", ptr, dotQuote(err.Error()))
+			return
+		}
+		fmt.Fprintf(w, "  p%d [label=%s];\n", ptr, dotQuote(nodeSummary(ptr, node, tree.nodeSize())))
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				fmt.Fprintf(w, "  p%d -> p%d;\n", ptr, node.getPtr(i))
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	if tree.root != 0 {
+		walk(tree.root)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// DOT 的字符串只需要转义引号和反斜杠
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
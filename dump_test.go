@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFmtBytes(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte("key"), `"key"`},
+		{[]byte("键"), `"键"`},
+		{[]byte{}, `""`},
+		{[]byte{0, 0xff}, "0x00ff"},
+		{[]byte("a\nb"), "0x610a62"},
+		{bytes.Repeat([]byte("x"), 100), `"` + strings.Repeat("x", 64) + `"... (100 bytes)`},
+	}
+	for _, c := range cases {
+		if got := fmtBytes(c.in); got != c.want {
+			t.Errorf("fmtBytes(%q) = %s, 应为 %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		val := "v"
+		if i == 10 {
+			val = strings.Repeat("o", 2*BTREE_PAGE_SIZE)
+		}
+		db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(val))
+	}
+	db.Set([]byte("bin"), []byte{0, 1, 2})
+	root := BNode(db.tree.get(db.tree.root))
+	owner := db.check().owner
+
+	t.Run("元数据页", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := dumpPage(&buf, db, owner, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), fmt.Sprintf("root: %d\n", db.tree.root)) {
+			t.Errorf("输出:\n%s", buf.String())
+		}
+	})
+
+	t.Run("节点", func(t *testing.T) {
+		var buf bytes.Buffer
+		dumpPage(&buf, db, owner, db.tree.root)
+		out := buf.String()
+		want := fmt.Sprintf(`key "" -> page %d`, root.getPtr(0))
+		if !strings.Contains(out, fmt.Sprintf("page %d: tree", db.tree.root)) ||
+			!strings.Contains(out, "type: internal") || !strings.Contains(out, "checksum: ok") ||
+			!strings.Contains(out, want) {
+			t.Errorf("输出:\n%s", out)
+		}
+
+		buf.Reset()
+		dumpPage(&buf, db, owner, root.getPtr(0))
+		out = buf.String()
+		if !strings.Contains(out, `key "bin" val 0x000102`) ||
+			!strings.Contains(out, `key "key0010" val overflow 8192 bytes at page`) {
+			t.Errorf("输出:\n%s", out)
+		}
+	})
+
+	t.Run("页号越界", func(t *testing.T) {
+		if err := dumpPage(&bytes.Buffer{}, db, owner, db.page.flushed); err == nil {
+			t.Error("应返回错误")
+		}
+		// 空文件中还没有任何页
+		empty := openTestKV(t, filepath.Join(t.TempDir(), "empty.db"))
+		defer empty.Close()
+		for _, ptr := range []uint64{0, 1} {
+			if err := dumpPage(&bytes.Buffer{}, empty, nil, ptr); err == nil || !strings.Contains(err.Error(), "out of range") {
+				t.Errorf("空文件的第 %d 页: %v", ptr, err)
+			}
+		}
+	})
+
+	t.Run("树的结构", func(t *testing.T) {
+		var buf bytes.Buffer
+		dumpTree(&buf, &db.tree)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 1+int(root.nkeys()) || !strings.HasPrefix(lines[1], "  page ") {
+			t.Errorf("输出:\n%s", buf.String())
+		}
+
+		buf.Reset()
+		dumpTreeDot(&buf, &db.tree)
+		out := buf.String()
+		edge := fmt.Sprintf("p%d -> p%d;", db.tree.root, root.getPtr(0))
+		if !strings.HasPrefix(out, "digraph btree {") || !strings.Contains(out, edge) ||
+			strings.Count(out, "->") != int(root.nkeys()) || !strings.Contains(out, `\"key0`) {
+			t.Errorf("输出:\n%s", out)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 空闲链表的节点，每个节点占一页
+// | next | pointers | unused |
+// |  8B  |   n×8B   |   ...  |
+type LNode []byte
+
+const FREE_LIST_HEADER = 8
+
+// 一个链表节点中能存放的页号数量
+func freeListCap(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER) / 8
+}
+
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[0:8])
+}
+
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[0:8], next)
+}
+
+func (node LNode) getPtr(idx int) uint64 {
+	pos := FREE_LIST_HEADER + 8*idx
+	return binary.LittleEndian.Uint64(node[pos:])
+}
+
+func (node LNode) setPtr(idx int, ptr uint64) {
+	pos := FREE_LIST_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[pos:], ptr)
+}
+
+// 存放被释放页号的链表，从尾部加入，从头部取出
+//
+// 链表中的每一项都有一个递增的序号 seq，项在节点内的位置是 seq 除以节点容量的余数。
+// 链表节点是原地修改的，但只会写入已提交的 tailSeq 之后的位置，
+// 因此更新失败或崩溃时，元数据页中记录的链表仍然完整。
+// 崩溃时尾节点可能只写入了一部分，其中已提交的项新旧内容相同，但页的校验和可能不一致，
+// 所以读取更新开始时的尾节点时不校验（见 KV.freeRead），代价是这一页真正损坏时发现不了。
+// 重用的空闲页通过 put 整页覆盖，不读取其中的旧内容，它同样可能是崩溃时没有写完的页。
+//
+// 读取链表节点失败或者链表断开时错误记录在 err 中，之后不再修改链表，调用者检查 err 并回滚本次更新。
+type FreeList struct {
+	// 管理页的回调
+	get func(uint64) ([]byte, error) // 读取一页
+	new func([]byte) uint64          // 追加一个新页
+	put func(uint64, []byte)         // 用新的内容覆盖一个空闲页
+	set func(uint64) ([]byte, error) // 原地修改一个已有的页
+	// 持久化在元数据页中的状态
+	headPage uint64
+	headSeq  uint64
+	tailPage uint64
+	tailSeq  uint64
+	// 内存中的状态
+	maxSeq uint64 // 本次更新开始时的 tailSeq，之后加入的项在提交之前不能取出
+	torn   uint64 // 本次更新开始时的 tailPage，崩溃时可能只写入了一部分
+	size   int    // 页大小，0 表示 BTREE_PAGE_SIZE
+	err    error  // 本次更新中读取链表节点的错误或者链表损坏的错误
+}
+
+// 页大小
+func (fl *FreeList) pageSize() int {
+	if fl.size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return fl.size
+}
+
+// 项在节点中的位置
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(freeListCap(fl.pageSize())))
+}
+
+// 空闲项的数量
+func (fl *FreeList) Total() int {
+	return int(fl.tailSeq - fl.headSeq)
+}
+
+// 开始新的一次更新，之前释放的页从此可以重用
+func (fl *FreeList) SetMaxSeq() {
+	fl.maxSeq = fl.tailSeq
+	fl.torn = fl.tailPage
+	fl.err = nil
+}
+
+// 从头部取出一个页号，没有可用的页时返回 0
+func (fl *FreeList) PopHead() uint64 {
+	ptr, head := flPop(fl)
+	if head != 0 {
+		// 取空的头节点本身也成为空闲页
+		fl.PushTail(head)
+	}
+	return ptr
+}
+
+// 从头部取出一项，如果头节点因此变空，同时返回头节点的页号
+func flPop(fl *FreeList) (ptr uint64, head uint64) {
+	if fl.err != nil || fl.headSeq == fl.maxSeq {
+		return 0, 0 // 不能取出本次更新中释放的页
+	}
+	page, err := fl.get(fl.headPage)
+	if err != nil {
+		fl.err = err
+		return 0, 0
+	}
+	node := LNode(page)
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq))
+	// 头节点用完了，移动到下一个节点
+	if fl.seq2idx(fl.headSeq+1) == 0 {
+		if node.getNext() == 0 {
+			// 还有项的链表在这里断了
+			fl.err = fmt.Errorf("page %d: %w: free list ends before its tail", fl.headPage, ErrCorruptPage)
+			return 0, 0
+		}
+		head, fl.headPage = fl.headPage, node.getNext()
+	}
+	fl.headSeq++
+	return ptr, head
+}
+
+// 在尾部加入一个被释放的页号
+func (fl *FreeList) PushTail(ptr uint64) {
+	tail := flSet(fl, fl.tailPage)
+	if tail == nil {
+		return
+	}
+	tail.setPtr(fl.seq2idx(fl.tailSeq), ptr)
+	fl.tailSeq++
+	// 尾节点满了，链接一个新的尾节点，保证链表永远不为空
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		// 优先从头部取一个空闲页
+		next, head := flPop(fl)
+		if next == 0 {
+			next = fl.new(make([]byte, fl.pageSize()))
+		} else {
+			fl.put(next, make([]byte, fl.pageSize()))
+		}
+		if tail = flSet(fl, fl.tailPage); tail == nil {
+			return
+		}
+		tail.setNext(next)
+		fl.tailPage = next
+		// 取空的头节点放入新的尾节点
+		if head != 0 {
+			if tail = flSet(fl, fl.tailPage); tail == nil {
+				return
+			}
+			tail.setPtr(0, head)
+			fl.tailSeq++
+		}
+	}
+}
+
+// 取得可以原地修改的链表节点，出错时记录错误并返回 nil
+func flSet(fl *FreeList, ptr uint64) LNode {
+	if fl.err != nil {
+		return nil
+	}
+	page, err := fl.set(ptr)
+	if err != nil {
+		fl.err = err
+		return nil
+	}
+	return LNode(page)
+}
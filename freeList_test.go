@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+type L struct {
+	free  FreeList
+	pages map[uint64][]byte
+	next  uint64 // 下一个追加的页号
+}
+
+func newL() *L {
+	l := &L{pages: map[uint64][]byte{1: make([]byte, BTREE_PAGE_SIZE)}, next: 2}
+	l.free = FreeList{
+		get: func(ptr uint64) ([]byte, error) {
+			return l.pages[ptr], nil
+		},
+		new: func(node []byte) uint64 {
+			ptr := l.next
+			l.next++
+			l.pages[ptr] = append([]byte{}, node...)
+			return ptr
+		},
+		put: func(ptr uint64, node []byte) {
+			l.pages[ptr] = append([]byte{}, node...)
+		},
+		set: func(ptr uint64) ([]byte, error) {
+			return l.pages[ptr], nil
+		},
+		headPage: 1,
+		tailPage: 1,
+	}
+	return l
+}
+
+// 取出所有可用的页号
+func (l *L) popAll() []uint64 {
+	var ptrs []uint64
+	for ptr := l.free.PopHead(); ptr != 0; ptr = l.free.PopHead() {
+		ptrs = append(ptrs, ptr)
+	}
+	return ptrs
+}
+
+func TestFreeList(t *testing.T) {
+	t.Run("本次更新释放的页不能取出", func(t *testing.T) {
+		l := newL()
+		l.free.SetMaxSeq()
+		l.free.PushTail(100)
+		if ptr := l.free.PopHead(); ptr != 0 {
+			t.Errorf("期望 0, 得到 %d", ptr)
+		}
+		l.free.SetMaxSeq()
+		if ptr := l.free.PopHead(); ptr != 100 {
+			t.Errorf("期望 100, 得到 %d", ptr)
+		}
+	})
+
+	t.Run("跨多个节点", func(t *testing.T) {
+		l := newL()
+		n := 3*freeListCap(BTREE_PAGE_SIZE) + 10
+		var pushed []uint64
+		for i := 0; i < n; i++ {
+			ptr := uint64(1000 + i)
+			l.free.PushTail(ptr)
+			pushed = append(pushed, ptr)
+		}
+		if l.free.Total() != n {
+			t.Errorf("数量错误: 期望 %d, 得到 %d", n, l.free.Total())
+		}
+		l.free.SetMaxSeq()
+		if got := l.popAll(); !slices.Equal(got, pushed) {
+			t.Errorf("取出的页号错误: 得到 %d 个", len(got))
+		}
+		// 用空的头节点被放回尾部，在下一次更新中才能取出
+		if l.free.Total() != 3 {
+			t.Errorf("期望回收 3 个链表节点, 得到 %d", l.free.Total())
+		}
+		l.free.SetMaxSeq()
+		for _, ptr := range l.popAll() {
+			if ptr >= 1000 {
+				t.Errorf("期望链表节点的页号, 得到 %d", ptr)
+			}
+		}
+	})
+
+	t.Run("链表节点的页被重用", func(t *testing.T) {
+		l := newL()
+		for i := 0; i < 2*freeListCap(BTREE_PAGE_SIZE); i++ {
+			l.free.PushTail(uint64(1000 + i))
+		}
+		appended := l.next
+		// 每次更新分配一些页，同时释放同样多的页
+		for round := 0; round < 50; round++ {
+			l.free.SetMaxSeq()
+			var ptrs []uint64
+			for i := 0; i < freeListCap(BTREE_PAGE_SIZE)/2; i++ {
+				ptrs = append(ptrs, l.free.PopHead())
+			}
+			for _, ptr := range ptrs {
+				l.free.PushTail(ptr)
+			}
+		}
+		if l.next != appended {
+			t.Errorf("链表节点没有被重用: 追加了 %d 页", l.next-appended)
+		}
+	})
+
+	t.Run("链表断开", func(t *testing.T) {
+		l := newL()
+		n := 2 * freeListCap(BTREE_PAGE_SIZE)
+		for i := 0; i < n; i++ {
+			l.free.PushTail(uint64(1000 + i))
+		}
+		LNode(l.pages[1]).setNext(0)
+		l.free.SetMaxSeq()
+		got := l.popAll()
+		if len(got) != freeListCap(BTREE_PAGE_SIZE)-1 || !errors.Is(l.free.err, ErrCorruptPage) {
+			t.Errorf("取出了 %d 页: %v", len(got), l.free.err)
+		}
+		// 出错之后不再修改链表
+		tailSeq := l.free.tailSeq
+		l.free.PushTail(1)
+		if l.free.tailSeq != tailSeq || l.free.PopHead() != 0 {
+			t.Error("出错之后链表被修改")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import "sync"
+
+// 组提交
+//
+// 每次提交都要 fsync，多个写入者各自提交时吞吐量受限于 fsync 的次数。
+// Update 把写入者的事务放入队列，排在队首的写入者成为 leader，
+// 取出当前队列中的所有事务，在同一个读写事务中依次执行，只提交（fsync）一次，
+// 然后唤醒这一组的所有写入者，返回各自的结果。leader 执行期间到达的事务组成下一组。
+//
+// 一组中的事务按到达的顺序执行，每个事务开始前记录保存点，
+// 返回错误时只回滚这个事务的修改，不影响同组的其他事务。
+type groupCommit struct {
+	mu    sync.Mutex
+	cond  sync.Cond
+	queue []*commitReq // 等待提交的事务，队首是正在执行的一组
+}
+
+// 队列中的一个事务
+type commitReq struct {
+	fn   func(tx *Tx) error
+	err  error
+	done bool
+}
+
+// 与其他并发的写入者一起执行 fn 并持久化，返回 fn 的错误或者提交的错误
+// fn 不能调用 tx.Commit 或 tx.Abort
+func (db *KV) Update(fn func(tx *Tx) error) error {
+	g := &db.group
+	req := &commitReq{fn: fn}
+	g.mu.Lock()
+	g.queue = append(g.queue, req)
+	for !req.done && g.queue[0] != req {
+		g.cond.Wait()
+	}
+	if req.done {
+		g.mu.Unlock()
+		return req.err
+	}
+	// 成为 leader，执行当前队列中的所有事务
+	batch := g.queue
+	g.mu.Unlock()
+
+	commitBatch(db, batch)
+
+	g.mu.Lock()
+	g.queue = g.queue[len(batch):]
+	for _, r := range batch {
+		r.done = true
+	}
+	g.cond.Broadcast()
+	g.mu.Unlock()
+	return req.err
+}
+
+// 在一个读写事务中执行一组事务并提交
+func commitBatch(db *KV, batch []*commitReq) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		for _, r := range batch {
+			r.err = err
+		}
+		return
+	}
+	for _, r := range batch {
+		sp := tx.savepoint()
+		r.err = r.fn(tx)
+		if tx.done {
+			// 页损坏时事务已经整个回滚，这一组都失败
+			for _, other := range batch {
+				other.err = r.err
+			}
+			return
+		}
+		if r.err != nil {
+			tx.rollback(sp)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		for _, r := range batch {
+			if r.err == nil {
+				r.err = err
+			}
+		}
+	}
+}
+
+// 读写事务中的保存点
+type savepoint struct {
+	meta    []byte // 空闲链表的位置
+	root    uint64
+	nappend uint64
+	nwal    int
+	niter   int
+}
+
+func (tx *Tx) savepoint() savepoint {
+	db := tx.db
+	return savepoint{meta: saveMeta(db), root: tx.tree.root, nappend: db.page.nappend,
+		nwal: len(tx.wal), niter: len(tx.iters)}
+}
+
+// 回滚到保存点，丢弃之后的修改
+// 之后从空闲链表取出的页重新回到链表中，它们在 updates 中的内容没有意义，写入文件也没有影响；
+// 之后追加在文件末尾的页直接丢弃。节点是写时复制的，保存点时的树没有被修改
+// 之后创建的迭代器可能引用这些页，在丢弃 updates 之前关闭
+func (tx *Tx) rollback(sp savepoint) {
+	db := tx.db
+	for _, iter := range tx.iters[sp.niter:] {
+		iter.Close()
+	}
+	tx.iters = tx.iters[:sp.niter]
+	loadMeta(db, sp.meta)
+	db.page.nappend = sp.nappend
+	for ptr := range db.page.updates {
+		if ptr >= db.page.flushed+db.page.nappend {
+			delete(db.page.updates, ptr)
+		}
+	}
+	tx.tree.root = sp.root
+	tx.wal = tx.wal[:sp.nwal]
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 等待队列中有 n 个事务
+func waitQueue(t *testing.T, db *KV, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		db.group.mu.Lock()
+		l := len(db.group.queue)
+		db.group.mu.Unlock()
+		if l == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("队列中的事务没有达到 %d 个", n)
+}
+
+func TestGroupCommit(t *testing.T) {
+	t.Run("并发的写入者", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					key := fmt.Sprintf("w%d-%03d", w, i)
+					if err := db.Set([]byte(key), []byte(key)); err != nil {
+						t.Error(err)
+						return
+					}
+					// 提交返回之后立即可见
+					if val, ok, _ := db.Get([]byte(key)); !ok || string(val) != key {
+						t.Errorf("键 %q: 得到 %q %v", key, val, ok)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		ref := map[string]string{}
+		for w := 0; w < 8; w++ {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("w%d-%03d", w, i)
+				ref[key] = key
+			}
+		}
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("一组只提交一次", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		version := db.latest.Load().version
+		// 让第一个写入者在开始事务时等待，之后的写入者排在它后面组成一组
+		db.writer.Lock()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Set([]byte("first"), []byte("v"))
+		}()
+		waitQueue(t, db, 1)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v"))
+			}()
+		}
+		waitQueue(t, db, 11)
+		db.writer.Unlock()
+		wg.Wait()
+		if n := db.latest.Load().version - version; n != 2 {
+			t.Errorf("11 个写入者应提交 2 次，实际 %d 次", n)
+		}
+		if len(db.group.queue) != 0 {
+			t.Errorf("队列中还有 %d 个事务", len(db.group.queue))
+		}
+	})
+
+	t.Run("失败的事务只回滚自己", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		ref := map[string]string{}
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte("v"))
+			ref[key] = "v"
+		}
+		errFail := errors.New("fail")
+		db.writer.Lock()
+		var wg sync.WaitGroup
+		errs := make([]error, 4)
+		update := func(i int, fn func(tx *Tx) error) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = db.Update(fn)
+			}()
+			waitQueue(t, db, i+1)
+		}
+		update(0, func(tx *Tx) error {
+			return tx.Set([]byte("a"), []byte("1"))
+		})
+		update(1, func(tx *Tx) error {
+			tx.DeleteRange([]byte("key100"), []byte("key400"))
+			tx.Set([]byte("b"), []byte("2"))
+			return errFail
+		})
+		update(2, func(tx *Tx) error {
+			_, err := tx.Del([]byte("key050"))
+			return err
+		})
+		update(3, func(tx *Tx) error {
+			// 超过上限的键不会修改树
+			return tx.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), nil)
+		})
+		db.writer.Unlock()
+		wg.Wait()
+		if errs[0] != nil || errs[1] != errFail || errs[2] != nil || !errors.Is(errs[3], ErrKeyTooLarge) {
+			t.Errorf("各事务的结果: %v", errs)
+		}
+		ref["a"] = "1"
+		delete(ref, "key050")
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("回滚时关闭迭代器", func(t *testing.T) {
+		db := openPagerKV(t, filepath.Join(t.TempDir(), "test.db"), 4)
+		defer db.Close()
+		for i := 0; i < 500; i++ {
+			db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v"))
+		}
+		errFail := errors.New("fail")
+		err := db.Update(func(tx *Tx) error {
+			for i := 0; i < 500; i++ {
+				tx.Set([]byte(fmt.Sprintf("new%03d", i)), []byte("v"))
+			}
+			// 迭代器引用本次更新中新建的页和文件中的页
+			for it := tx.SeekGE(nil); it.Valid(); it.Next() {
+			}
+			tx.SeekGE([]byte("new250"))
+			return errFail
+		})
+		if err != errFail {
+			t.Errorf("期望 errFail, 得到 %v", err)
+		}
+		if n := pagerPins(db.pager); n != 0 {
+			t.Errorf("回滚之后还有 %d 个 pin", n)
+		}
+		if _, ok, _ := db.Get([]byte("new000")); ok {
+			t.Error("失败的事务不应生效")
+		}
+		if err := db.Set([]byte("a"), []byte("1")); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// 基于单个文件的 KV 存储，B+树的页通过 mmap（或者 pread 和页缓存，见 pager.go）读取，通过 pwrite 追加
+//
+// 文件布局：
+// | meta | page 1 | page 2 | ... |
+// 第 0 页保留给元数据，记录根节点指针、已使用的页数和空闲链表的位置
+// 被释放的页进入空闲链表，在之后的更新中重用，文件不会无限增长
+// 其他页以 4 字节的校验和开头（见 checksum.go），读取时发现损坏的页
+//
+// 节点总是写时复制的，新页只追加在文件末尾，已有的页不会被修改；
+// 只有在新页全部落盘之后才更新元数据页，切换到新的根节点。
+// 因此更新中途崩溃时，重新打开后读到的仍是上一次提交的树。
+type KV struct {
+	Path string
+	// 新建文件时的页大小，0 表示 BTREE_PAGE_SIZE
+	// 打开已有文件时以元数据页中记录的为准，设置了不同的值会打开失败
+	PageSize int
+	// 新建的节点使用前缀压缩的格式，记录在元数据页中
+	// 节点的格式记录在各自的页中，两种格式可以共存，打开已有文件时任一方设置了都会启用
+	PrefixCompression bool
+	// 新建文件时不使用页校验和，打开已有文件时以元数据页中记录的为准
+	NoChecksum bool
+	// 读到校验和不一致的页时的处理方式
+	OnCorrupt CorruptPolicy
+	// 大于 0 时不使用 mmap，通过 pread 读取页，最多缓存这么多页，见 pager.go
+	CachePages int
+	// 使用预写日志，提交时只 fsync 日志，B+树的页在检查点才落盘，见 wal.go
+	// 不论是否设置，打开时都会重放上一次留下的日志，只读打开时除外
+	WAL bool
+	// 日志超过这个大小时做检查点，0 表示 WAL_CHECKPOINT_SIZE
+	CheckpointSize int
+	// 只读打开：不重放也不删除日志，不写入文件，读到的是最后一次写入元数据页的提交
+	// 写事务返回 ErrReadOnly
+	ReadOnly bool
+	// 内部状态
+	fp   *os.File
+	tree BTree
+	free FreeList
+	mmap struct {
+		file   int      // 文件大小，可以大于数据库大小
+		total  int      // mmap 的大小，可以大于文件大小
+		chunks [][]byte // 多段 mmap，彼此不一定连续
+	}
+	page struct {
+		flushed uint64            // 已写入文件的页数
+		nappend uint64            // 本次更新追加在文件末尾的页数
+		updates map[uint64][]byte // 本次更新新建或修改的页
+	}
+	wal struct {
+		fp      *os.File // WAL 模式下的日志文件，否则为 nil
+		size    int64    // 日志中完整的记录的字节数
+		tailSeq uint64   // 上一次检查点时空闲链表的尾部序号，只有之前的空闲页可以重用
+	}
+	pager    *pager     // 使用页缓存时代替 mmap
+	failed   bool       // 上一次更新失败，磁盘上的元数据页可能需要恢复
+	checksum bool       // 每一页的页头保存校验和
+	writer   sync.Mutex // 同一时间只有一个写事务
+	// 读事务和写入者共享的状态
+	latest    atomic.Pointer[snapshot] // 最新提交的快照
+	snapshots []*snapshot              // 可能还有读事务的快照，按版本排序，只由写入者访问
+	// 等待组提交的写入者，见 groupCommit.go
+	group groupCommit
+}
+
+// mmap 的初始大小
+const MMAP_INIT_SIZE = 64 << 20
+
+// 打开或创建数据库文件
+func (db *KV) Open() error {
+	if err := kvOpen(db); err != nil {
+		db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	return nil
+}
+
+// 文件被其他进程打开时 Open 返回的错误
+var ErrLocked = errors.New("database is locked by another process")
+
+func kvOpen(db *KV) error {
+	flag, lock := os.O_RDWR|os.O_CREATE, syscall.LOCK_EX
+	if db.ReadOnly {
+		flag, lock = os.O_RDONLY, syscall.LOCK_SH
+	}
+	fp, err := os.OpenFile(db.Path, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	db.fp = fp
+	// 同一时间只有一个进程打开文件写入，只读打开的进程之间可以共享
+	// 锁随文件关闭释放
+	if err := syscall.Flock(int(fp.Fd()), lock|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrLocked
+		}
+		return fmt.Errorf("flock: %w", err)
+	}
+	sz, err := fileSize(db.fp)
+	if err != nil {
+		return err
+	}
+	db.mmap.file = sz
+	// 初始化 mmap，使用页缓存时在读取元数据之后创建页缓存
+	if db.CachePages == 0 {
+		chunk, err := mmapInit(db.fp, sz)
+		if err != nil {
+			return err
+		}
+		db.mmap.total = len(chunk)
+		db.mmap.chunks = [][]byte{chunk}
+	}
+	// B+树的回调
+	db.tree.get = db.pageRead
+	db.tree.new = db.pageAlloc
+	db.tree.del = db.free.PushTail
+	// 空闲链表的回调
+	db.free.get = db.freeRead
+	db.free.new = db.pageAppend
+	db.free.put = db.pageReuse
+	db.free.set = db.pageWrite
+	db.page.updates = map[uint64][]byte{}
+	db.group.cond.L = &db.group.mu
+	// 读取元数据
+	if err := masterLoad(db); err != nil {
+		return err
+	}
+	if db.CachePages > 0 {
+		db.pager = newPager(db.fp, db.PageSize, db.CachePages)
+		if db.checksum {
+			db.pager.verify = pageVerify
+		}
+	}
+	db.tree.size = db.PageSize - db.pageHeader()
+	db.tree.prefix = db.PrefixCompression
+	db.tree.check = db.pageReadCheck
+	if db.pager != nil {
+		db.tree.unpin = db.pageUnpin
+	}
+	db.free.size = db.PageSize - db.pageHeader()
+	publishCommit(db)
+	return walOpen(db)
+}
+
+// 关闭数据库，释放 mmap
+// WAL 模式下先做检查点，失败时日志保留，下次打开时重放
+func (db *KV) Close() {
+	if db.wal.fp != nil {
+		if db.wal.size > 0 {
+			_ = checkpoint(db)
+		}
+		_ = db.wal.fp.Close()
+		db.wal.fp = nil
+	}
+	for _, chunk := range db.mmap.chunks {
+		err := syscall.Munmap(chunk)
+		if err != nil {
+			panic(err) // 只有地址错误才会失败
+		}
+	}
+	db.mmap.chunks = nil
+	db.pager = nil
+	if db.fp != nil {
+		_ = db.fp.Close()
+		db.fp = nil
+	}
+}
+
+// 读取一个键，页损坏时返回错误
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Abort()
+	return tx.Get(key)
+}
+
+// 以下单个操作的更新都通过组提交持久化，见 Update
+
+// 写入一个键值对并持久化
+func (db *KV) Set(key []byte, val []byte) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Set(key, val)
+	})
+}
+
+// 按 req.Mode 插入或更新一个键值对，只有实际修改时才持久化
+func (db *KV) InsertEx(req *UpdateReq) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.InsertEx(req)
+	})
+}
+
+// 当前值等于 expected 时写入 newVal 并持久化，expected 为 nil 表示期望键不存在
+func (db *KV) CompareAndSwap(key []byte, expected []byte, newVal []byte) (bool, error) {
+	req := &UpdateReq{Key: key, Val: newVal, Mode: MODE_CAS, Expect: expected}
+	if err := db.InsertEx(req); err != nil {
+		return false, err
+	}
+	return casMatched(req), nil
+}
+
+// 删除一个键并持久化
+func (db *KV) Del(key []byte) (bool, error) {
+	deleted := false
+	err := db.Update(func(tx *Tx) (err error) {
+		deleted, err = tx.Del(key)
+		return err
+	})
+	return deleted && err == nil, err
+}
+
+// 删除一个键并持久化，被删除的值写回 req.Old
+func (db *KV) DeleteEx(req *DeleteReq) (bool, error) {
+	deleted := false
+	err := db.Update(func(tx *Tx) (err error) {
+		deleted, err = tx.DeleteEx(req)
+		return err
+	})
+	return deleted && err == nil, err
+}
+
+// 把严格递增的键值对批量导入空数据库并持久化，返回导入的键数
+func (db *KV) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	count, err := tx.BulkLoad(kvs, fill)
+	if err != nil {
+		tx.Abort()
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// 删除 [start, end) 范围内的所有键并持久化，返回删除的键数
+func (db *KV) DeleteRange(start, end []byte) (int, error) {
+	count := 0
+	err := db.Update(func(tx *Tx) (err error) {
+		count, err = tx.DeleteRange(start, end)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// 文件大小
+// 这里还不知道页大小，只检查最小的页大小，读取元数据之后再检查一次
+func fileSize(fp *os.File) (int, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+		return 0, errors.New("file size is not a multiple of page size")
+	}
+	return int(fi.Size()), nil
+}
+
+// 创建覆盖整个文件的初始 mmap
+func mmapInit(fp *os.File, fileSize int) ([]byte, error) {
+	mmapSize := MMAP_INIT_SIZE
+	for mmapSize < fileSize {
+		mmapSize *= 2
+	}
+	// mmapSize 可以大于文件大小，只要不访问文件末尾之后的页即可
+	chunk, err := syscall.Mmap(
+		int(fp.Fd()), 0, mmapSize, syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	return chunk, nil
+}
+
+// 扩展 mmap，每次新增一段与当前总大小相同的映射，使地址空间翻倍
+// 已有的映射保持不变，之前返回的页仍然有效
+func extendMmap(db *KV, npages int) error {
+	for db.mmap.total < npages*db.PageSize {
+		if err := mmapDouble(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mmapDouble(db *KV) error {
+	chunk, err := syscall.Mmap(
+		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
+		syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	db.mmap.total += db.mmap.total
+	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	return nil
+}
+
+// 按需扩展文件，每次按当前大小的 1/8 增长以减少扩展次数
+func extendFile(db *KV, npages int) error {
+	filePages := db.mmap.file / db.PageSize
+	if filePages >= npages {
+		return nil
+	}
+	for filePages < npages {
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+	fileSize := filePages * db.PageSize
+	if err := db.fp.Truncate(int64(fileSize)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	db.mmap.file = fileSize
+	return nil
+}
+
+// 页头的大小，使用校验和时页的前 4 字节不属于节点
+func (db *KV) pageHeader() int {
+	if db.checksum {
+		return PAGE_CHECKSUM_SIZE
+	}
+	return 0
+}
+
+// 回调 BTree.get，根据页号读取页，不含页头
+func (db *KV) pageRead(ptr uint64) []byte {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page[db.pageHeader():] // 本次更新中新建或修改的页
+	}
+	return db.readPage(db.mmap.chunks, ptr)[db.pageHeader():]
+}
+
+// 回调 BTree.check，检查页号并校验 pageRead 将要读取的页
+func (db *KV) pageReadCheck(ptr uint64) error {
+	if err := checkPagePtr(ptr, db.page.flushed+db.page.nappend); err != nil {
+		return err
+	}
+	if _, ok := db.page.updates[ptr]; ok {
+		return nil // 还没有写入文件
+	}
+	return db.pageCheck(db.mmap.chunks, ptr)
+}
+
+// 回调 BTree.unpin，释放 pageReadCheck 时 pin 住的页
+func (db *KV) pageUnpin(ptr uint64) {
+	if _, ok := db.page.updates[ptr]; !ok {
+		db.pager.unpin(ptr)
+	}
+}
+
+// 回调 FreeList.get，与 tree.get 一样校验读取的页
+// 链表节点在返回之前就释放了，见 pager 关于淘汰的说明
+// 更新开始时的尾节点不校验，崩溃时它可能只写入了一部分，见 FreeList
+func (db *KV) freeRead(ptr uint64) ([]byte, error) {
+	if _, ok := db.page.updates[ptr]; !ok && ptr == db.free.torn {
+		err := checkPagePtr(ptr, db.page.flushed)
+		var page []byte
+		if err == nil {
+			page, err = pageReadFile(db, ptr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", ptr, err)
+		}
+		return page[db.pageHeader():], nil
+	}
+	if err := db.pageReadCheck(ptr); err != nil {
+		return nil, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	page := db.pageRead(ptr)
+	if db.pager != nil {
+		db.pageUnpin(ptr)
+	}
+	return page, nil
+}
+
+// 损坏的页中的页号可能超出文件，在读取之前检查，npages 是可以读取的页数
+// 第 0 页是元数据，不会被其他页引用
+func checkPagePtr(ptr uint64, npages uint64) error {
+	if ptr == 0 || ptr >= npages {
+		return fmt.Errorf("%w: page number out of range (%d pages)", ErrCorruptPage, npages)
+	}
+	return nil
+}
+
+// 读取已写入文件的页，不校验；使用页缓存时返回读取的错误
+func pageReadFile(db *KV, ptr uint64) ([]byte, error) {
+	if db.pager != nil {
+		page, err := db.pager.fetch(ptr)
+		if errors.Is(err, ErrChecksum) {
+			err = nil // 由调用者校验
+		}
+		return page, err
+	}
+	return mmapRead(db.mmap.chunks, ptr, db.PageSize), nil
+}
+
+// 从页缓存或者 chunks 中读取已写入文件的页，chunks 是读取者可见的 mmap
+// 使用页缓存时这一页必须已经通过 pageCheck pin 住
+func (db *KV) readPage(chunks [][]byte, ptr uint64) []byte {
+	if db.pager != nil {
+		return db.pager.get(ptr)
+	}
+	return mmapRead(chunks, ptr, db.PageSize)
+}
+
+func mmapRead(chunks [][]byte, ptr uint64, pageSize int) []byte {
+	size := uint64(pageSize)
+	start := uint64(0)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/size
+		if ptr < end {
+			offset := size * (ptr - start)
+			return chunk[offset : offset+size]
+		}
+		start = end
+	}
+	panic("mmapRead: bad ptr")
+}
+
+// 回调 BTree.new，分配一个新页，优先重用空闲链表中的页
+func (db *KV) pageAlloc(node []byte) uint64 {
+	if len(node) > db.PageSize-db.pageHeader() {
+		panic("pageAlloc: node larger than a page")
+	}
+	if ptr := db.free.PopHead(); ptr != 0 {
+		db.pageReuse(ptr, node)
+		return ptr
+	}
+	return db.pageAppend(node)
+}
+
+// 回调 FreeList.new，在文件末尾追加一个新页
+func (db *KV) pageAppend(node []byte) uint64 {
+	ptr := db.page.flushed + db.page.nappend
+	db.page.nappend++
+	db.page.updates[ptr] = db.pageCopy(node)
+	return ptr
+}
+
+// 回调 FreeList.put，用节点覆盖一个空闲页，不读取其中的旧内容
+func (db *KV) pageReuse(ptr uint64, node []byte) {
+	db.page.updates[ptr] = db.pageCopy(node)
+}
+
+// 回调 FreeList.set，返回一个可以原地修改的页
+func (db *KV) pageWrite(ptr uint64) ([]byte, error) {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page[db.pageHeader():], nil
+	}
+	node, err := db.freeRead(ptr)
+	if err != nil {
+		return nil, err
+	}
+	page := db.pageCopy(node)
+	db.page.updates[ptr] = page
+	return page[db.pageHeader():], nil
+}
+
+// 将节点复制到一个完整大小的页中，页头在写入文件时填写
+func (db *KV) pageCopy(node []byte) []byte {
+	page := make([]byte, db.PageSize)
+	copy(page[db.pageHeader():], node)
+	return page
+}
+
+const DB_SIG = "MyDB_BTreeFile01" // 元数据页的签名，16 字节
+const DB_VERSION = 2              // 文件格式的版本
+
+// 元数据页的格式
+// | sig | version | page size | root | used pages | free list head | free list tail | flags |
+// | 16B |    4B   |     4B    |  8B  |     8B     |    8B + 8B     |    8B + 8B     |   8B  |
+// 空闲链表的头尾各记录页号和序号
+// 记录页大小之前的文件这个位置是 0，表示 BTREE_PAGE_SIZE；flags 同样在旧文件中是 0
+const META_SIZE = 80
+
+// 元数据页中 flags 的各个位
+const (
+	META_FLAG_PREFIX   = 1 // 新建的节点使用前缀压缩
+	META_FLAG_CHECKSUM = 2 // 每一页的页头保存校验和
+)
+
+func saveMeta(db *KV) []byte {
+	var data [META_SIZE]byte
+	copy(data[0:16], DB_SIG)
+	binary.LittleEndian.PutUint32(data[16:], DB_VERSION)
+	binary.LittleEndian.PutUint32(data[20:], uint32(db.PageSize))
+	binary.LittleEndian.PutUint64(data[24:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[32:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[48:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[64:], db.free.tailSeq)
+	var flags uint64
+	if db.PrefixCompression {
+		flags |= META_FLAG_PREFIX
+	}
+	if db.checksum {
+		flags |= META_FLAG_CHECKSUM
+	}
+	binary.LittleEndian.PutUint64(data[72:], flags)
+	return data[:]
+}
+
+// 读取文件中的元数据页
+func readMeta(db *KV) ([]byte, error) {
+	if db.mmap.chunks != nil {
+		return db.mmap.chunks[0][:META_SIZE], nil
+	}
+	data := make([]byte, META_SIZE)
+	if _, err := db.fp.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("read meta page: %w", err)
+	}
+	return data, nil
+}
+
+func loadMeta(db *KV, data []byte) {
+	db.tree.root = binary.LittleEndian.Uint64(data[24:])
+	db.page.flushed = binary.LittleEndian.Uint64(data[32:])
+	db.free.headPage = binary.LittleEndian.Uint64(data[40:])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[48:])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[56:])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[64:])
+}
+
+// 读取元数据页
+func masterLoad(db *KV) error {
+	if db.mmap.file == 0 {
+		// 空文件，第 0 页留给元数据，第 1 页是空闲链表的第一个节点
+		if db.PageSize == 0 {
+			db.PageSize = BTREE_PAGE_SIZE
+		}
+		if err := checkPageSize(db.PageSize); err != nil {
+			return err
+		}
+		db.checksum = !db.NoChecksum
+		db.page.flushed = 2
+		db.free.headPage = 1
+		db.free.tailPage = 1
+		db.page.updates[1] = make([]byte, db.PageSize)
+		return nil
+	}
+	data, err := readMeta(db)
+	if err != nil {
+		return err
+	}
+	if string(data[:16]) != DB_SIG {
+		return errors.New("bad signature")
+	}
+	if version := binary.LittleEndian.Uint32(data[16:]); version != DB_VERSION {
+		return fmt.Errorf("unsupported file version %d", version)
+	}
+	size := int(binary.LittleEndian.Uint32(data[20:]))
+	if size == 0 {
+		size = BTREE_PAGE_SIZE
+	}
+	if err := checkPageSize(size); err != nil {
+		return err
+	}
+	if db.PageSize != 0 && db.PageSize != size {
+		return fmt.Errorf("page size mismatch: file %d, requested %d", size, db.PageSize)
+	}
+	db.PageSize = size
+	flags := binary.LittleEndian.Uint64(data[72:])
+	if flags&META_FLAG_PREFIX != 0 {
+		db.PrefixCompression = true
+	}
+	db.checksum = flags&META_FLAG_CHECKSUM != 0
+	if db.mmap.file%size != 0 {
+		return errors.New("file size is not a multiple of page size")
+	}
+	loadMeta(db, data)
+	// 检查元数据是否与文件大小一致
+	bad := db.page.flushed < 2 ||
+		db.page.flushed > uint64(db.mmap.file/size) ||
+		db.tree.root >= db.page.flushed ||
+		!(0 < db.free.headPage && db.free.headPage < db.page.flushed) ||
+		!(0 < db.free.tailPage && db.free.tailPage < db.page.flushed) ||
+		db.free.headSeq > db.free.tailSeq
+	if bad {
+		return errors.New("bad master page")
+	}
+	return nil
+}
+
+// 更新元数据页，写入不超过一个扇区，可以认为是原子的
+func masterStore(db *KV) error {
+	if _, err := db.fp.WriteAt(saveMeta(db), 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	return nil
+}
+
+// 提交一次更新，失败时把内存中的状态回滚到上一次提交
+func updateOrRevert(db *KV, meta []byte) error {
+	// 上一次更新失败后，磁盘上的元数据页可能已被部分写入，
+	// 先用内存中上一次提交的元数据覆盖它
+	if db.failed {
+		if err := masterStore(db); err != nil {
+			return err
+		}
+		if err := db.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+		db.failed = false
+	}
+	err := updateFile(db)
+	if err != nil {
+		// 新页可能已写入一部分，但由于元数据页没有指向它们，不影响已提交的树
+		db.failed = true
+		revertPages(db, meta)
+		return err
+	}
+	publishCommit(db)
+	return nil
+}
+
+// 开始一次更新，返回当前的元数据用于失败时回滚
+// 本次更新之前释放的页可以重用，除非仍对某个读事务可见
+func beginUpdate(db *KV) []byte {
+	db.free.SetMaxSeq()
+	// 去掉已经没有读事务的旧快照，最新的快照之后还可能有读事务
+	latest := db.latest.Load()
+	live := db.snapshots[:0]
+	for _, snap := range db.snapshots {
+		if snap == latest || snap.readers.Load() > 0 {
+			live = append(live, snap)
+		}
+	}
+	clear(db.snapshots[len(live):])
+	db.snapshots = live
+	db.free.maxSeq = min(db.free.maxSeq, live[0].tailSeq)
+	if db.wal.fp != nil {
+		// 上一次检查点的树在崩溃后还要用到，之后释放的页不能重用
+		db.free.maxSeq = min(db.free.maxSeq, db.wal.tailSeq)
+	}
+	return saveMeta(db)
+}
+
+// 更新成功后，让之后开始的读事务看到新的版本
+func publishCommit(db *KV) {
+	snap := &snapshot{root: db.tree.root, tailSeq: db.free.tailSeq, npages: db.page.flushed,
+		chunks: db.mmap.chunks}
+	if prev := db.latest.Load(); prev != nil {
+		snap.version = prev.version + 1
+	} else {
+		snap.version = 1
+	}
+	db.snapshots = append(db.snapshots, snap)
+	db.latest.Store(snap)
+}
+
+// 丢弃本次更新的所有页，回到 meta 记录的状态
+func revertPages(db *KV, meta []byte) {
+	loadMeta(db, meta)
+	db.page.nappend = 0
+	clear(db.page.updates)
+}
+
+// 两阶段写入：先写新页并 fsync，再写元数据页并 fsync
+func updateFile(db *KV) error {
+	// 1. 写入新页
+	if err := writePages(db); err != nil {
+		return err
+	}
+	// 2. fsync，保证元数据页落盘之前新页已经落盘
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	// 3. 原子地切换根节点
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	// 4. fsync，使这次更新持久化
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// 将本次更新新建或修改的页写入文件
+func writePages(db *KV) error {
+	npages := int(db.page.flushed + db.page.nappend)
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	if db.pager == nil {
+		if err := extendMmap(db, npages); err != nil {
+			return err
+		}
+	}
+	for ptr, page := range db.page.updates {
+		if db.checksum {
+			pageSetChecksum(page, ptr)
+		}
+		if _, err := db.fp.WriteAt(page, int64(ptr)*int64(db.PageSize)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+		if db.pager != nil {
+			db.pager.put(ptr, page)
+		}
+	}
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	clear(db.page.updates)
+	return nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 在临时目录中打开一个数据库
+func openTestKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	return db
+}
+
+func TestKV(t *testing.T) {
+	t.Run("读写", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+
+		if _, found, _ := db.Get([]byte("k1")); found {
+			t.Error("空数据库中不应找到键")
+		}
+		if err := db.Set([]byte("k1"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if val, found, _ := db.Get([]byte("k1")); !found || string(val) != "v1" {
+			t.Errorf("读取错误: 得到 %q %v", val, found)
+		}
+		if db.tree.root == 0 {
+			t.Error("第 0 页保留给元数据，不应作为根节点")
+		}
+		deleted, err := db.Del([]byte("k1"))
+		if err != nil || !deleted {
+			t.Fatalf("删除失败: %v %v", deleted, err)
+		}
+		if _, found, _ := db.Get([]byte("k1")); found {
+			t.Error("已删除的键仍然存在")
+		}
+	})
+
+	t.Run("重新打开", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		ref := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%04d", i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			ref[key] = val
+		}
+		for i := 0; i < 2000; i += 3 {
+			key := fmt.Sprintf("key%04d", i)
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, key)
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if BNode(db.tree.get(db.tree.root)).btype() != BNODE_NODE {
+			t.Error("根节点应为内部节点")
+		}
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			val, found, _ := db.Get([]byte(key))
+			if want, ok := ref[key]; ok != found || string(val) != want {
+				t.Errorf("键 %q 错误: 期望 %q %v, 得到 %q %v", key, want, ok, val, found)
+			}
+		}
+	})
+
+	t.Run("范围删除", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		tx, _ := db.Begin(false)
+		for i := 0; i < 3000; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		req := &DeleteReq{Key: []byte("key0000")}
+		if deleted, err := db.DeleteEx(req); err != nil || !deleted || string(req.Old) != "val" {
+			t.Fatalf("删除错误: %v %v %q", deleted, err, req.Old)
+		}
+		free := db.free.Total()
+		count, err := db.DeleteRange([]byte("key1000"), []byte("key2000"))
+		if err != nil || count != 1000 {
+			t.Fatalf("删除数量错误: %d %v", count, err)
+		}
+		if db.free.Total() <= free {
+			t.Error("删除的页应进入空闲链表")
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		for i := 0; i < 3000; i++ {
+			_, found, _ := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+			if want := i != 0 && (i < 1000 || i >= 2000); found != want {
+				t.Errorf("键 key%04d: 期望存在 %v", i, want)
+			}
+		}
+	})
+
+	t.Run("页大小", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, PageSize: 16 << 10}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		big := randVal(100000)
+		for i := 0; i < 2000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), big[:i*10]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+		if fi, _ := os.Stat(path); fi.Size()%(16<<10) != 0 {
+			t.Errorf("文件大小 %d 不是页的整数倍", fi.Size())
+		}
+
+		db = &KV{Path: path, PageSize: 8 << 10}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Error("页大小不一致时应打开失败")
+		}
+		db = openTestKV(t, path)
+		defer db.Close()
+		if db.PageSize != 16<<10 {
+			t.Errorf("应使用文件中的页大小: %d", db.PageSize)
+		}
+		for i := 0; i < 2000; i++ {
+			if val, _, _ := db.Get([]byte(fmt.Sprintf("key%04d", i))); !bytes.Equal(val, big[:i*10]) {
+				t.Fatalf("键 key%04d 的值错误", i)
+			}
+		}
+		tx, _ := db.Begin(true)
+		defer tx.Abort()
+		if val, _, _ := tx.Get([]byte("key1999")); !bytes.Equal(val, big[:19990]) {
+			t.Error("读事务读取的值错误")
+		}
+
+		bad := &KV{Path: filepath.Join(t.TempDir(), "bad.db"), PageSize: 5000}
+		if err := bad.Open(); err == nil {
+			bad.Close()
+			t.Error("非法的页大小应打开失败")
+		}
+	})
+
+	t.Run("前缀压缩", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, PrefixCompression: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("tenant/%04d/user/%08d", i%7, i)
+			if err := db.Set([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if !db.PrefixCompression {
+			t.Error("应使用文件中记录的前缀压缩")
+		}
+		if root := BNode(db.tree.get(db.tree.root)); root.prefix() == nil {
+			t.Error("根节点应使用前缀压缩的格式")
+		}
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("tenant/%04d/user/%08d", i%7, i)
+			if val, _, _ := db.Get([]byte(key)); string(val) != key {
+				t.Fatalf("键 %s 的值错误", key)
+			}
+		}
+		if count, err := db.DeleteRange([]byte("tenant/0003/"), []byte("tenant/0005/")); err != nil || count == 0 {
+			t.Fatalf("范围删除错误: %d %v", count, err)
+		}
+		if _, found, _ := db.Get([]byte("tenant/0004/user/00000004")); found {
+			t.Error("范围内的键应被删除")
+		}
+	})
+
+	t.Run("文件大小不是页的整数倍", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(path, []byte("garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db := &KV{Path: path}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Error("应拒绝损坏的文件")
+		}
+	})
+
+	t.Run("签名错误", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(path, make([]byte, 2*BTREE_PAGE_SIZE), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db := &KV{Path: path}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Error("应拒绝签名错误的文件")
+		}
+	})
+
+	t.Run("只读打开", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		db.Set([]byte("key"), []byte("val"))
+		// 写入者独占文件
+		ro := &KV{Path: path, ReadOnly: true}
+		if err := ro.Open(); !errors.Is(err, ErrLocked) {
+			t.Errorf("期望 ErrLocked, 得到 %v", err)
+		}
+		db.Close()
+
+		ro = &KV{Path: path, ReadOnly: true}
+		if err := ro.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		if val, ok, err := ro.Get([]byte("key")); !ok || string(val) != "val" || err != nil {
+			t.Errorf("读取错误: %q %v %v", val, ok, err)
+		}
+		if err := ro.Set([]byte("key"), []byte("new")); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("期望 ErrReadOnly, 得到 %v", err)
+		}
+		// 只读打开的进程之间共享，但不能再打开写入
+		ro2 := &KV{Path: path, ReadOnly: true}
+		if err := ro2.Open(); err != nil {
+			t.Errorf("只读打开应该可以共享: %v", err)
+		}
+		ro2.Close()
+		if err := (&KV{Path: path}).Open(); !errors.Is(err, ErrLocked) {
+			t.Errorf("期望 ErrLocked, 得到 %v", err)
+		}
+	})
+
+	t.Run("页号越界", func(t *testing.T) {
+		for _, bad := range []uint64{5000, 1 << 40} {
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := &KV{Path: path, NoChecksum: true}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v"))
+			}
+			root := db.tree.root
+			db.Close()
+
+			// 把根节点的第一个子节点指针改成超出文件的页号
+			fp, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := make([]byte, BTREE_PAGE_SIZE)
+			fp.ReadAt(page, int64(root)*BTREE_PAGE_SIZE)
+			BNode(page).setPtr(0, bad)
+			fp.WriteAt(page, int64(root)*BTREE_PAGE_SIZE)
+			fp.Close()
+
+			db = openTestKV(t, path)
+			if _, _, err := db.Get([]byte("key0000")); !errors.Is(err, ErrCorruptPage) {
+				t.Errorf("页号 %d: 期望 ErrCorruptPage, 得到 %v", bad, err)
+			}
+			if err := db.Set([]byte("key0000"), []byte("new")); !errors.Is(err, ErrCorruptPage) {
+				t.Errorf("页号 %d: 期望 ErrCorruptPage, 得到 %v", bad, err)
+			}
+			if val, ok, err := db.Get([]byte("key0999")); !ok || string(val) != "v" || err != nil {
+				t.Errorf("其他子树应能正常读取: %q %v %v", val, ok, err)
+			}
+			db.Close()
+		}
+	})
+}
+
+func TestKVFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 反复更新同一批键，旧页被回收重用，文件大小保持稳定
+	used := db.page.flushed
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 500; i += 7 {
+			val := fmt.Sprintf("v%d", round)
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if db.page.flushed > used+20 {
+		t.Errorf("文件持续增长: %d 页 -> %d 页", used, db.page.flushed)
+	}
+	db.Close()
+
+	// 重新打开后空闲链表仍然可用
+	db = openTestKV(t, path)
+	defer db.Close()
+	if db.free.Total() == 0 {
+		t.Error("空闲链表为空")
+	}
+	used = db.page.flushed
+	for i := 0; i < 500; i++ {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.page.flushed != used {
+		t.Errorf("删除不应追加页: %d 页 -> %d 页", used, db.page.flushed)
+	}
+	for i := 0; i < 500; i++ {
+		if _, found, _ := db.Get([]byte(fmt.Sprintf("key%03d", i))); found {
+			t.Fatalf("已删除的键仍然存在: key%03d", i)
+		}
+	}
+}
+
+func TestKVCrash(t *testing.T) {
+	t.Run("元数据页写入前崩溃", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 模拟崩溃：新页已落盘，但元数据页还没有更新
+		db.tree.Insert([]byte("key050"), []byte("new"))
+		db.tree.Insert([]byte("key100"), []byte("new"))
+		if err := writePages(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.fp.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if val, _, _ := db.Get([]byte("key050")); string(val) != "old" {
+			t.Errorf("未提交的更新可见: 得到 %q", val)
+		}
+		if _, found, _ := db.Get([]byte("key100")); found {
+			t.Error("未提交的插入可见")
+		}
+		// 之后的更新正常进行
+		if err := db.Set([]byte("key100"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if val, _, _ := db.Get([]byte("key100")); string(val) != "new" {
+			t.Errorf("更新错误: 得到 %q", val)
+		}
+	})
+
+	t.Run("写入失败后回滚", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		if err := db.Set([]byte("k1"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		root := db.tree.root
+
+		// 换成只读的文件句柄使写入失败
+		rw := db.fp
+		ro, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.fp = ro
+		if err := db.Set([]byte("k2"), []byte("v2")); err == nil {
+			t.Fatal("写入只读文件应失败")
+		}
+		db.fp = rw
+		_ = ro.Close()
+
+		if db.tree.root != root {
+			t.Error("失败后根节点应回滚")
+		}
+		if _, found, _ := db.Get([]byte("k2")); found {
+			t.Error("失败的写入可见")
+		}
+		if err := db.Set([]byte("k3"), []byte("v3")); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		for key, want := range map[string]string{"k1": "v1", "k3": "v3"} {
+			if val, found, _ := db.Get([]byte(key)); !found || string(val) != want {
+				t.Errorf("键 %q 错误: 得到 %q %v", key, val, found)
+			}
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// mydb 是操作数据库文件的命令行工具
+//
+//	mydb check <file>                检查文件的一致性，发现问题时退出码为 1
+//	mydb dump <file> <page>...       解码并输出指定的页
+//	mydb tree [-dot] <file>          输出树的结构，-dot 输出 Graphviz DOT
+//	mydb backup <file> <dest>        写出压缩过的一致的备份，dest 为 - 时写到标准输出
+//
+// 所有命令都以只读方式打开文件，不重放 WAL 模式留下的日志，看到的是最后一次检查点；
+// 文件正被其他进程打开写入时命令失败。
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// 子命令，args 不含子命令的名字
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"check":  cmdCheck,
+	"dump":   cmdDump,
+	"tree":   cmdTree,
+	"backup": cmdBackup,
+}
+
+const usage = `usage: mydb <command> [arguments]
+
+commands:
+  check <file>             verify the consistency of a database file
+  dump <file> <page>...    decode and print the given pages
+  tree [-dot] <file>       print the tree structure, or Graphviz DOT with -dot
+  backup <file> <dest>     write a compacted consistent copy to dest, or stdout if dest is -
+
+The file is opened read-only and must not be open in another process.
+`
+
+// 执行命令行，返回退出码
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "mydb: unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+	if err := cmd(args[1:], stdout); err != nil {
+		fmt.Fprintf(stderr, "mydb %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// 以只读方式打开一个已有的数据库文件，不存在时不会创建
+func openExisting(path string) (*KV, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db := &KV{Path: path, ReadOnly: true}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// 取出唯一的参数，即数据库文件的路径
+func fileArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected exactly one database file")
+	}
+	return args[0], nil
+}
+
+func cmdCheck(args []string, stdout io.Writer) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	db, err := openExisting(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	r := db.Check()
+	fmt.Fprintf(stdout, "pages: %d (tree %d, overflow %d, free list %d, free %d)\n",
+		r.Pages, r.TreePages, r.OverflowPages, r.FreeListPages, r.FreePages)
+	fmt.Fprintf(stdout, "keys: %d, height: %d\n", r.Keys, r.Height)
+	for _, p := range r.Problems {
+		fmt.Fprintln(stdout, p)
+	}
+	if !r.OK() {
+		return fmt.Errorf("%d problems found", len(r.Problems))
+	}
+	return nil
+}
+
+func cmdDump(args []string, stdout io.Writer) error {
+	if len(args) < 2 {
+		return errors.New("expected a database file and page numbers")
+	}
+	var ptrs []uint64
+	for _, arg := range args[1:] {
+		ptr, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad page number %q", arg)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	db, err := openExisting(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// 每一页的用途只需要检查一次
+	owner := db.check().owner
+	for i, ptr := range ptrs {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		if err := dumpPage(stdout, db, owner, ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdTree(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("tree", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dot := fs.Bool("dot", false, "emit Graphviz DOT")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path, err := fileArg(fs.Args())
+	if err != nil {
+		return err
+	}
+	db, err := openExisting(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+	if *dot {
+		dumpTreeDot(stdout, &tx.tree)
+	} else {
+		dumpTree(stdout, &tx.tree)
+	}
+	return nil
+}
+
+// 备份没有被其他进程打开的文件；其他进程的写入者看不到这里的快照，可能重用正在复制的页，
+// 因此文件正在使用时只读打开失败，在线备份请在拥有数据库的进程中调用 KV.Backup
+func cmdBackup(args []string, stdout io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("expected a database file and a destination")
+	}
+	db, err := openExisting(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if args[1] == "-" {
+		return db.Backup(stdout)
+	}
+	// 不覆盖已有的文件，失败时删除写了一半的备份
+	fp, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	err = db.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(args[1])
+		return err
+	}
+	return nil
+}
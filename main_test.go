@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 执行命令行，返回退出码和输出
+func runCmd(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestMain_Usage(t *testing.T) {
+	if code, _, stderr := runCmd(); code != 2 || !strings.Contains(stderr, "usage") {
+		t.Errorf("没有参数: %d %q", code, stderr)
+	}
+	if code, _, stderr := runCmd("nope"); code != 2 || !strings.Contains(stderr, "unknown command") {
+		t.Errorf("未知的命令: %d %q", code, stderr)
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	t.Run("正常的文件", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		writeChecksumDB(t, path, "")
+		code, stdout, stderr := runCmd("check", path)
+		if code != 0 || !strings.Contains(stdout, "keys: 1000") {
+			t.Errorf("退出码 %d, 输出 %q %q", code, stdout, stderr)
+		}
+	})
+
+	t.Run("损坏的文件", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+		code, stdout, stderr := runCmd("check", path)
+		if code != 1 || !strings.Contains(stdout, "checksum mismatch") || !strings.Contains(stderr, "problems found") {
+			t.Errorf("退出码 %d, 输出 %q %q", code, stdout, stderr)
+		}
+	})
+
+	t.Run("参数错误", func(t *testing.T) {
+		if code, _, _ := runCmd("check"); code != 1 {
+			t.Errorf("缺少文件: 退出码 %d", code)
+		}
+		missing := filepath.Join(t.TempDir(), "missing.db")
+		if code, _, _ := runCmd("check", missing); code != 1 {
+			t.Errorf("文件不存在: 退出码 %d", code)
+		}
+	})
+
+	t.Run("不重放日志", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		db.Set([]byte("old"), []byte("v"))
+		db.Checkpoint()
+		db.Set([]byte("new"), []byte("v"))
+		// 数据库打开时拒绝运行
+		if code, _, stderr := runCmd("check", path); code != 1 || !strings.Contains(stderr, "locked") {
+			t.Errorf("退出码 %d, 输出 %q", code, stderr)
+		}
+		walCrash(db)
+
+		// 崩溃后留下的日志保持不变，只看到检查点的内容
+		log, _ := os.ReadFile(path + WAL_SUFFIX)
+		if code, stdout, stderr := runCmd("check", path); code != 0 || !strings.Contains(stdout, "keys: 1") {
+			t.Errorf("退出码 %d, 输出 %q %q", code, stdout, stderr)
+		}
+		if after, err := os.ReadFile(path + WAL_SUFFIX); err != nil || !bytes.Equal(after, log) {
+			t.Errorf("日志被修改: %v", err)
+		}
+		db = openTestKV(t, path)
+		defer db.Close()
+		verifyKV(t, db, map[string]string{"old": "v", "new": "v"})
+	})
+}
+
+func TestCmdDumpTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writeChecksumDB(t, path, "")
+	if code, stdout, stderr := runCmd("dump", path, "0", "1"); code != 0 ||
+		!strings.Contains(stdout, "page 0: meta") || !strings.Contains(stdout, "page 1: ") {
+		t.Errorf("dump: 退出码 %d, 输出 %q %q", code, stdout, stderr)
+	}
+	if code, _, stderr := runCmd("dump", path, "x"); code != 1 || !strings.Contains(stderr, "bad page number") {
+		t.Errorf("错误的页号: 退出码 %d, %q", code, stderr)
+	}
+	if code, stdout, _ := runCmd("tree", path); code != 0 || !strings.Contains(stdout, "internal") {
+		t.Errorf("tree: 退出码 %d, 输出 %q", code, stdout)
+	}
+	if code, stdout, _ := runCmd("tree", "-dot", path); code != 0 || !strings.HasPrefix(stdout, "digraph") {
+		t.Errorf("tree -dot: 退出码 %d, 输出 %q", code, stdout)
+	}
+}
+
+func TestCmdBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	writeChecksumDB(t, path, "")
+	dest := filepath.Join(dir, "backup.db")
+	if code, _, stderr := runCmd("backup", path, dest); code != 0 {
+		t.Fatalf("退出码 %d, %q", code, stderr)
+	}
+	if code, stdout, _ := runCmd("check", dest); code != 0 || !strings.Contains(stdout, "keys: 1000") {
+		t.Errorf("备份的检查: 退出码 %d, 输出 %q", code, stdout)
+	}
+	// 不覆盖已有的文件
+	if code, _, _ := runCmd("backup", path, dest); code != 1 {
+		t.Errorf("目标已存在: 退出码 %d", code)
+	}
+	code, stdout, _ := runCmd("backup", path, "-")
+	if fi, err := os.Stat(dest); code != 0 || err != nil || int64(len(stdout)) != fi.Size() {
+		t.Errorf("写到标准输出: 退出码 %d, %d 字节", code, len(stdout))
+	}
+	if code, _, _ := runCmd("backup", path); code != 1 {
+		t.Errorf("缺少参数: 退出码 %d", code)
+	}
+
+	// 其他进程的写入者看不到这里的快照，数据库正在使用时拒绝备份
+	db := openTestKV(t, path)
+	defer db.Close()
+	live := filepath.Join(dir, "live.db")
+	if code, _, stderr := runCmd("backup", path, live); code != 1 || !strings.Contains(stderr, "locked") {
+		t.Errorf("数据库正在使用: 退出码 %d, %q", code, stderr)
+	}
+	if _, err := os.Stat(live); !os.IsNotExist(err) {
+		t.Errorf("不应创建备份文件: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 溢出页，存放超过节点中值的上限的值，多个溢出页串成链表
+// | type | size | next | data |
+// |  2B  |  2B  |  8B  |  ... |
+// size 是本页中数据的字节数，next 是下一个溢出页，最后一页为 0
+const BNODE_OVERFLOW = 3
+
+const OVERFLOW_HEADER = 12
+
+// 一个溢出页中数据的容量，溢出页总是使用整个页
+func overflowCap(pageSize int) int {
+	return pageSize - OVERFLOW_HEADER
+}
+
+// 存放在溢出页中的值的最大大小
+const BTREE_MAX_OVERFLOW_SIZE = 64 << 20
+
+// 叶节点中指向溢出页链表的引用
+// | total size | first page |
+// |     8B     |     8B     |
+const OVERFLOW_REF_SIZE = 16
+
+// 将值写入一串溢出页，返回保存在叶节点中的引用
+// 从最后一页开始写，这样每一页都能记录下一页的页号
+func overflowWrite(tree *BTree, val []byte) []byte {
+	capacity := overflowCap(tree.pageSize())
+	next := uint64(0)
+	for end := len(val); end > 0; {
+		start := (end - 1) / capacity * capacity
+		page := make([]byte, tree.pageSize())
+		binary.LittleEndian.PutUint16(page[0:2], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint16(page[2:4], uint16(end-start))
+		binary.LittleEndian.PutUint64(page[4:12], next)
+		copy(page[OVERFLOW_HEADER:], val[start:end])
+		next = tree.new(page)
+		end = start
+	}
+	ref := make([]byte, OVERFLOW_REF_SIZE)
+	binary.LittleEndian.PutUint64(ref[0:8], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[8:16], next)
+	return ref
+}
+
+// 检查引用中记录的值的大小，返回链表应有的页数
+// 值的大小来自磁盘，在按它分配内存或者遍历链表之前检查；
+// 大小为 0 时链表应为空，否则遍历时发现链表过长，同样报告损坏
+func overflowPages(tree *BTree, ref []byte) (int, error) {
+	total := binary.LittleEndian.Uint64(ref[0:8])
+	if total > BTREE_MAX_OVERFLOW_SIZE {
+		first := binary.LittleEndian.Uint64(ref[8:16])
+		return 0, fmt.Errorf("page %d: %w: bad overflow value size %d", first, ErrCorruptPage, total)
+	}
+	capacity := uint64(overflowCap(tree.pageSize()))
+	return int((total + capacity - 1) / capacity), nil
+}
+
+// 根据引用读取溢出页，拼接出完整的值
+func overflowRead(tree *BTree, ref []byte) ([]byte, error) {
+	n, err := overflowPages(tree, ref)
+	if err != nil {
+		return nil, err
+	}
+	total := binary.LittleEndian.Uint64(ref[0:8])
+	val := make([]byte, 0, total)
+	first := binary.LittleEndian.Uint64(ref[8:16])
+	ptr := first
+	for ; ptr != 0 && n > 0; n-- {
+		page, err := overflowLoad(tree, ptr)
+		if err != nil {
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint16(page[2:4])
+		val = append(val, page[OVERFLOW_HEADER:][:size]...)
+		next := binary.LittleEndian.Uint64(page[4:12])
+		treeUnpin(tree, ptr)
+		ptr = next
+	}
+	if ptr != 0 {
+		// 链表比记录的长，也可能有环
+		return nil, fmt.Errorf("page %d: %w: overflow chain longer than its value", ptr, ErrCorruptPage)
+	}
+	if uint64(len(val)) != total {
+		return nil, fmt.Errorf("page %d: %w: overflow value has at least %d bytes, expected %d",
+			first, ErrCorruptPage, len(val), total)
+	}
+	return val, nil
+}
+
+// 释放引用指向的所有溢出页，链表比值的大小对应的页数长时（包括有环）报告损坏
+func overflowFree(tree *BTree, ref []byte) error {
+	n, err := overflowPages(tree, ref)
+	if err != nil {
+		return err
+	}
+	ptr := binary.LittleEndian.Uint64(ref[8:16])
+	for ; ptr != 0 && n > 0; n-- {
+		page, err := overflowLoad(tree, ptr)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint64(page[4:12])
+		treeUnpin(tree, ptr)
+		tree.del(ptr)
+		ptr = next
+	}
+	if ptr != 0 {
+		return fmt.Errorf("page %d: %w: overflow chain longer than its value", ptr, ErrCorruptPage)
+	}
+	return nil
+}
+
+// 读取一个溢出页并检查页头，用完之后由调用者释放
+func overflowLoad(tree *BTree, ptr uint64) ([]byte, error) {
+	page, err := treePage(tree, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if t := binary.LittleEndian.Uint16(page[0:2]); t != BNODE_OVERFLOW {
+		treeUnpin(tree, ptr)
+		return nil, fmt.Errorf("page %d: %w: bad overflow page type %d", ptr, ErrCorruptPage, t)
+	}
+	if n := binary.LittleEndian.Uint16(page[2:4]); int(n) > overflowCap(len(page)) {
+		treeUnpin(tree, ptr)
+		return nil, fmt.Errorf("page %d: %w: overflow page size %d too large", ptr, ErrCorruptPage, n)
+	}
+	return page, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 生成指定大小的随机值
+func randVal(n int) []byte {
+	val := make([]byte, n)
+	rand.Read(val)
+	return val
+}
+
+func TestOverflow(t *testing.T) {
+	t.Run("写入和读取", func(t *testing.T) {
+		c := newC()
+		for _, n := range []int{0, 1, overflowCap(BTREE_PAGE_SIZE) - 1, overflowCap(BTREE_PAGE_SIZE), overflowCap(BTREE_PAGE_SIZE) + 1, 3 * overflowCap(BTREE_PAGE_SIZE), 1 << 20} {
+			val := randVal(n)
+			ref := overflowWrite(&c.tree, val)
+			if got, err := overflowRead(&c.tree, ref); err != nil || !bytes.Equal(got, val) {
+				t.Errorf("大小 %d 的值读取错误", n)
+			}
+			overflowFree(&c.tree, ref)
+			if len(c.pages) != 0 {
+				t.Errorf("大小 %d 的值释放后仍有 %d 页", n, len(c.pages))
+			}
+		}
+	})
+
+	t.Run("大值的插入查找和遍历", func(t *testing.T) {
+		c := newC()
+		ref := map[string][]byte{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			val := randVal(i * 100) // 从内联到溢出的各种大小
+			c.tree.Insert([]byte(key), val)
+			ref[key] = val
+		}
+		c.tree.Insert([]byte("huge"), randVal(3<<20))
+		ref["huge"], _, _ = c.tree.Get([]byte("huge"))
+		if len(ref["huge"]) != 3<<20 {
+			t.Fatalf("大值长度错误: %d", len(ref["huge"]))
+		}
+		for key, val := range ref {
+			if got, found, _ := c.tree.Get([]byte(key)); !found || !bytes.Equal(got, val) {
+				t.Errorf("键 %q 的值错误: 长度 %d", key, len(got))
+			}
+		}
+		n := 0
+		seq, errf := c.tree.RangeErr(nil, nil)
+		for k, v := range seq {
+			if !bytes.Equal(v, ref[string(k)]) {
+				t.Errorf("遍历时键 %q 的值错误", k)
+			}
+			n++
+		}
+		if n != len(ref) || errf() != nil {
+			t.Errorf("遍历的键数量错误: 期望 %d, 得到 %d: %v", len(ref), n, errf())
+		}
+	})
+
+	t.Run("更新和删除释放溢出页", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 50; i++ {
+			c.add(fmt.Sprintf("key%03d", i), "small")
+		}
+		npages := len(c.pages)
+
+		c.tree.Insert([]byte("key010"), randVal(100000))
+		if len(c.pages) <= npages {
+			t.Fatal("大值应写入溢出页")
+		}
+		// 大值换成另一个大值
+		big := randVal(50000)
+		c.tree.Insert([]byte("key010"), big)
+		if got, _, _ := c.tree.Get([]byte("key010")); !bytes.Equal(got, big) {
+			t.Error("更新后的值错误")
+		}
+		// 大值换成小值，溢出页被释放
+		c.tree.Insert([]byte("key010"), []byte("small"))
+		if len(c.pages) != npages {
+			t.Errorf("更新为小值后溢出页没有释放: %d 页 -> %d 页", npages, len(c.pages))
+		}
+
+		c.tree.Insert([]byte("key020"), randVal(100000))
+		if ok, _ := c.tree.Delete([]byte("key020")); !ok {
+			t.Fatal("删除失败")
+		}
+		c.tree.Insert([]byte("key020"), []byte("small"))
+		if len(c.pages) != npages {
+			t.Errorf("删除后溢出页没有释放: %d 页 -> %d 页", npages, len(c.pages))
+		}
+	})
+
+	t.Run("损坏的溢出页", func(t *testing.T) {
+		c := newC()
+		ref := overflowWrite(&c.tree, randVal(3*overflowCap(BTREE_PAGE_SIZE)))
+		first := binary.LittleEndian.Uint64(ref[8:16])
+		// 链表比记录的长度短
+		short := slices.Clone(ref)
+		binary.LittleEndian.PutUint64(short[0:8], 4*uint64(overflowCap(BTREE_PAGE_SIZE)))
+		if _, err := overflowRead(&c.tree, short); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("长度不一致: 期望 ErrCorruptPage, 得到 %v", err)
+		}
+		// 页的类型错误
+		binary.LittleEndian.PutUint16(c.pages[first][0:2], BNODE_LEAF)
+		if _, err := overflowRead(&c.tree, ref); !errors.Is(err, ErrCorruptPage) ||
+			!strings.Contains(err.Error(), fmt.Sprintf("page %d", first)) {
+			t.Errorf("类型错误: 期望带有页号的 ErrCorruptPage, 得到 %v", err)
+		}
+		if err := overflowFree(&c.tree, ref); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("释放: 期望 ErrCorruptPage, 得到 %v", err)
+		}
+	})
+
+	t.Run("损坏的引用", func(t *testing.T) {
+		c := newC()
+		ref := overflowWrite(&c.tree, randVal(3*overflowCap(BTREE_PAGE_SIZE)))
+		// 记录的大小不合法时不按它分配内存
+		for _, total := range []uint64{0, BTREE_MAX_OVERFLOW_SIZE + 1, 1 << 62} {
+			bad := slices.Clone(ref)
+			binary.LittleEndian.PutUint64(bad[0:8], total)
+			if _, err := overflowRead(&c.tree, bad); !errors.Is(err, ErrCorruptPage) {
+				t.Errorf("大小 %d: 期望 ErrCorruptPage, 得到 %v", total, err)
+			}
+			if err := overflowFree(&c.tree, bad); !errors.Is(err, ErrCorruptPage) {
+				t.Errorf("大小 %d: 期望 ErrCorruptPage, 得到 %v", total, err)
+			}
+		}
+		// 最后一页指回第一页，链表有环
+		first := binary.LittleEndian.Uint64(ref[8:16])
+		last := first
+		for next := first; next != 0; next = binary.LittleEndian.Uint64(c.pages[next][4:12]) {
+			last = next
+		}
+		binary.LittleEndian.PutUint64(c.pages[last][4:12], first)
+		if _, err := overflowRead(&c.tree, ref); !errors.Is(err, ErrCorruptPage) {
+			t.Errorf("有环: 期望 ErrCorruptPage, 得到 %v", err)
+		}
+		freed := 0
+		c.tree.del = func(uint64) { freed++ }
+		if err := overflowFree(&c.tree, ref); !errors.Is(err, ErrCorruptPage) || freed != 3 {
+			t.Errorf("有环: 释放了 %d 页, 期望 ErrCorruptPage, 得到 %v", freed, err)
+		}
+	})
+
+	t.Run("持久化", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		val := randVal(1 << 20)
+		if err := db.Set([]byte("blob"), val); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), randVal(5000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		if got, _, _ := db.Get([]byte("blob")); !bytes.Equal(got, val) {
+			t.Error("重新打开后大值错误")
+		}
+		// 删除大值后溢出页进入空闲链表
+		free := db.free.Total()
+		if _, err := db.Del([]byte("blob")); err != nil {
+			t.Fatal(err)
+		}
+		if db.free.Total() < free+(1<<20)/overflowCap(BTREE_PAGE_SIZE) {
+			t.Errorf("溢出页没有进入空闲链表: %d -> %d", free, db.free.Total())
+		}
+	})
+}
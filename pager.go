@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// 基于 pread 的页缓存，用于不适合使用 mmap 的环境（见 KV.CachePages）
+//
+// 缓存最多保存 capacity 个页，按 CLOCK 算法淘汰：每个帧有一个访问位，
+// 指针循环扫描所有帧，清除遇到的访问位，淘汰第一个访问位已经清除的帧。
+// pin 住的帧不会被淘汰，所有帧都被 pin 住时缓存临时超出容量。
+//
+// 树在使用一个节点期间 pin 住它：tree.check 时 pin，用完之后通过 tree.unpin 释放，
+// get 只读取已经 pin 住的页，不会读文件，I/O 错误都从 pin 返回。
+// 因此缓存中只有正在使用的页超出容量，数量不超过树的高度乘以同时进行的操作数。
+// 被淘汰的帧只是从缓存中移除，内存交给 GC 回收而不会用来存放其他页，
+// 已经取得的页在 unpin 之后仍然可以读取，只是不再计入容量。
+// 文件中的页只在没有快照引用它时才会被覆盖，写入时同时更新缓存，见 put。
+type pager struct {
+	fp       *os.File
+	pageSize int
+	capacity int
+	verify   func(page []byte, ptr uint64) error // 读入页时的校验，可以为 nil
+
+	mu     sync.Mutex
+	frames map[uint64]*frame
+	clock  []*frame // 所有的帧，CLOCK 的指针在其中循环
+	hand   int
+	hits   uint64
+	misses uint64
+}
+
+// 缓存中的一个页
+type frame struct {
+	ptr  uint64
+	data []byte
+	err  error // 读入时校验的结果
+	pins int
+	ref  bool // CLOCK 的访问位
+}
+
+// 页缓存的命中统计
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Pages  int // 缓存中的页数
+}
+
+func newPager(fp *os.File, pageSize int, capacity int) *pager {
+	return &pager{fp: fp, pageSize: pageSize, capacity: capacity, frames: map[uint64]*frame{}}
+}
+
+// 读取一页并记入命中统计，返回的错误是 I/O 错误或者读入时校验的错误
+func (p *pager) fetch(ptr uint64) ([]byte, error) {
+	f, err := p.lookup(ptr, true)
+	if err != nil {
+		return nil, err
+	}
+	return f.data, f.err
+}
+
+// 读取已经 pin 住的页，不记入统计，校验失败时仍然返回页的内容
+// 用于 tree.get 等没有错误返回值的路径，之前必须已经通过 pin 读入这一页
+func (p *pager) get(ptr uint64) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.frames[ptr]
+	if !ok || f.pins == 0 {
+		panic("pager: get a page that is not pinned")
+	}
+	f.ref = true
+	return f.data
+}
+
+// pin 住一页，在 unpin 之前这一页不会被淘汰
+// 返回 I/O 错误时没有 pin 住，返回校验的错误时已经 pin 住
+func (p *pager) pin(ptr uint64) ([]byte, error) {
+	for {
+		f, err := p.lookup(ptr, true)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		// 释放锁之后这个帧可能已经被淘汰
+		if p.frames[ptr] == f {
+			f.pins++
+			p.mu.Unlock()
+			return f.data, f.err
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *pager) unpin(ptr uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.frames[ptr]
+	if !ok || f.pins == 0 {
+		panic("pager: unpin a page that is not pinned")
+	}
+	f.pins--
+}
+
+// 返回缓存中的帧，不在缓存中时从文件读入
+// 读文件时不持有锁，两个读者同时读入同一页时保留先放入缓存的帧
+func (p *pager) lookup(ptr uint64, count bool) (*frame, error) {
+	p.mu.Lock()
+	if f, ok := p.frames[ptr]; ok {
+		f.ref = true
+		if count {
+			p.hits++
+		}
+		p.mu.Unlock()
+		return f, nil
+	}
+	if count {
+		p.misses++
+	}
+	p.mu.Unlock()
+
+	data := make([]byte, p.pageSize)
+	if _, err := p.fp.ReadAt(data, int64(ptr)*int64(p.pageSize)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", ptr, err)
+	}
+	f := &frame{ptr: ptr, data: data, ref: true}
+	if p.verify != nil {
+		f.err = p.verify(data, ptr)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.frames[ptr]; ok {
+		return old, nil
+	}
+	p.insert(f)
+	return f, nil
+}
+
+// 写入文件之后更新缓存中的页，不在缓存中时同样放入缓存，新写入的页很可能马上被读取
+func (p *pager) put(ptr uint64, page []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.frames[ptr]; ok {
+		f.data, f.err, f.ref = page, nil, true
+		return
+	}
+	p.insert(&frame{ptr: ptr, data: page, ref: true})
+}
+
+// 放入一个新的帧，缓存已满时按 CLOCK 淘汰一个帧，调用者持有锁
+func (p *pager) insert(f *frame) {
+	p.frames[f.ptr] = f
+	if len(p.clock) < p.capacity {
+		p.clock = append(p.clock, f)
+		return
+	}
+	// 最多扫描两圈：第一圈清除访问位，第二圈一定能找到没有 pin 住的帧
+	for i := 0; i < 2*len(p.clock); i++ {
+		victim := p.clock[p.hand]
+		switch {
+		case victim.pins > 0:
+		case victim.ref:
+			victim.ref = false
+		default:
+			delete(p.frames, victim.ptr)
+			if len(p.clock) > p.capacity {
+				// 之前临时超出了容量，移除这个帧
+				p.clock = slices.Delete(p.clock, p.hand, p.hand+1)
+				if p.hand == len(p.clock) {
+					p.hand = 0
+				}
+				continue
+			}
+			p.clock[p.hand] = f
+			p.hand = (p.hand + 1) % len(p.clock)
+			return
+		}
+		p.hand = (p.hand + 1) % len(p.clock)
+	}
+	// 所有的帧都被 pin 住
+	p.clock = append(p.clock, f)
+}
+
+func (p *pager) stats() CacheStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return CacheStats{Hits: p.hits, Misses: p.misses, Pages: len(p.frames)}
+}
+
+// 页缓存的命中统计，不使用页缓存时返回零值
+func (db *KV) CacheStats() CacheStats {
+	if db.pager == nil {
+		return CacheStats{}
+	}
+	return db.pager.stats()
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 创建一个有 n 页的文件，每页以页号开头
+func writePagerFile(t *testing.T, n int) *os.File {
+	t.Helper()
+	fp, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fp.Close() })
+	for i := 0; i < n; i++ {
+		page := make([]byte, BTREE_PAGE_SIZE)
+		page[0] = byte(i)
+		fp.WriteAt(page, int64(i)*BTREE_PAGE_SIZE)
+	}
+	return fp
+}
+
+// 以页缓存模式打开数据库
+func openPagerKV(t *testing.T, path string, pages int) *KV {
+	t.Helper()
+	db := &KV{Path: path, CachePages: pages}
+	if err := db.Open(); err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	return db
+}
+
+func TestPager(t *testing.T) {
+	t.Run("容量", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 20), BTREE_PAGE_SIZE, 4)
+		for i := 0; i < 20; i++ {
+			if page, _ := p.fetch(uint64(i)); page[0] != byte(i) {
+				t.Fatalf("第 %d 页的内容错误", i)
+			}
+			if len(p.frames) > 4 || len(p.clock) > 4 {
+				t.Fatalf("缓存了 %d 页，超过容量", len(p.frames))
+			}
+		}
+	})
+
+	t.Run("CLOCK 淘汰", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 10), BTREE_PAGE_SIZE, 3)
+		p.fetch(0)
+		p.fetch(1)
+		p.fetch(2)
+		// 第一圈清除所有访问位，淘汰第 0 页
+		p.fetch(3)
+		if _, ok := p.frames[0]; ok {
+			t.Error("第 0 页应被淘汰")
+		}
+		// 再次访问第 2 页，淘汰时跳过它
+		p.fetch(2)
+		p.fetch(4)
+		if _, ok := p.frames[1]; ok {
+			t.Error("第 1 页应被淘汰")
+		}
+		if _, ok := p.frames[2]; !ok {
+			t.Error("最近访问的第 2 页不应被淘汰")
+		}
+	})
+
+	t.Run("pin", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 10), BTREE_PAGE_SIZE, 2)
+		for i := 0; i < 3; i++ {
+			if _, err := p.pin(uint64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 所有的帧都被 pin 住时临时超出容量
+		if len(p.frames) != 3 {
+			t.Errorf("缓存了 %d 页, 期望 3 页", len(p.frames))
+		}
+		for i := 3; i < 10; i++ {
+			p.fetch(uint64(i))
+			for j := 0; j < 3; j++ {
+				if _, ok := p.frames[uint64(j)]; !ok {
+					t.Fatalf("pin 住的第 %d 页被淘汰", j)
+				}
+			}
+		}
+		for i := 0; i < 3; i++ {
+			p.unpin(uint64(i))
+		}
+		// unpin 之后缓存逐渐缩小到容量之内
+		for i := 3; i < 10; i++ {
+			p.fetch(uint64(i))
+		}
+		if len(p.frames) > 2 || len(p.clock) > 2 {
+			t.Errorf("unpin 之后缓存了 %d 页", len(p.frames))
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("unpin 没有 pin 住的页应该 panic")
+				}
+			}()
+			p.unpin(0)
+		}()
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("get 没有 pin 住的页应该 panic")
+				}
+			}()
+			p.get(9)
+		}()
+	})
+
+	t.Run("命中统计", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 10), BTREE_PAGE_SIZE, 4)
+		for i := 0; i < 3; i++ {
+			p.fetch(1)
+			p.fetch(2)
+		}
+		// get 不记入统计
+		p.pin(3)
+		p.get(3)
+		if s := p.stats(); s.Hits != 4 || s.Misses != 3 || s.Pages != 3 {
+			t.Errorf("统计错误: %+v", s)
+		}
+	})
+
+	t.Run("写入时更新缓存", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 10), BTREE_PAGE_SIZE, 4)
+		p.fetch(1)
+		page := make([]byte, BTREE_PAGE_SIZE)
+		page[0] = 100
+		p.put(1, page)
+		p.put(5, page)
+		p1, _ := p.fetch(1)
+		p5, _ := p.fetch(5)
+		if p1[0] != 100 || p5[0] != 100 {
+			t.Error("应读到写入的内容")
+		}
+	})
+
+	t.Run("读取错误", func(t *testing.T) {
+		p := newPager(writePagerFile(t, 2), BTREE_PAGE_SIZE, 4)
+		if _, err := p.fetch(5); err == nil {
+			t.Error("读取文件末尾之后的页应返回错误")
+		}
+		if len(p.frames) != 0 {
+			t.Error("读取失败的页不应放入缓存")
+		}
+		if _, err := p.pin(5); err == nil {
+			t.Error("pin 文件末尾之后的页应返回错误")
+		}
+	})
+}
+
+// 缓存中 pin 住的页数
+func pagerPins(p *pager) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, f := range p.frames {
+		n += f.pins
+	}
+	return n
+}
+
+func TestKVPager(t *testing.T) {
+	t.Run("读写", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openPagerKV(t, path, 16)
+		if db.mmap.chunks != nil {
+			t.Error("使用页缓存时不应使用 mmap")
+		}
+		ref := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%d", i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			ref[key] = val
+		}
+		for i := 0; i < 2000; i += 3 {
+			key := fmt.Sprintf("key%04d", i)
+			db.Del([]byte(key))
+			delete(ref, key)
+		}
+		verifyKV(t, db, ref)
+		if s := db.CacheStats(); s.Pages > 16 || s.Hits == 0 || s.Misses == 0 {
+			t.Errorf("缓存统计: %+v", s)
+		}
+		if n := pagerPins(db.pager); n != 0 {
+			t.Errorf("操作结束之后还有 %d 个 pin", n)
+		}
+		db.Close()
+
+		// 重新打开，页都从文件读入
+		db = openPagerKV(t, path, 16)
+		defer db.Close()
+		verifyKV(t, db, ref)
+		if val, ok, _ := db.Get([]byte("key0001")); !ok || string(val) != "val1" {
+			t.Errorf("读取错误: %q %v", val, ok)
+		}
+	})
+
+	t.Run("与 mmap 打开的文件兼容", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		ref := map[string]string{}
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte(key))
+			ref[key] = key
+		}
+		db.Close()
+		db = openPagerKV(t, path, 8)
+		defer db.Close()
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("迭代器和事务释放页", func(t *testing.T) {
+		db := openPagerKV(t, filepath.Join(t.TempDir(), "test.db"), 4)
+		defer db.Close()
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			db.Set([]byte(key), []byte(strings.Repeat("v", i%7*1000))) // 包括溢出页
+		}
+		db.DeleteRange([]byte("key0100"), []byte("key0900"))
+		tx, _ := db.Begin(true)
+		n := 0
+		seq, errf := tx.RangeErr(nil, nil)
+		for range seq {
+			n++
+			if s := db.CacheStats(); s.Pages > 4+8 {
+				t.Fatalf("遍历时缓存了 %d 页", s.Pages)
+			}
+		}
+		if n != 1200 || errf() != nil {
+			t.Errorf("遍历了 %d 个键: %v", n, errf())
+		}
+		it := tx.SeekGE([]byte("key1000"))
+		it.Next()
+		if pagerPins(db.pager) == 0 {
+			t.Error("迭代器应 pin 住路径上的节点")
+		}
+		tx.Abort()
+		if n := pagerPins(db.pager); n != 0 {
+			t.Errorf("事务结束之后还有 %d 个 pin", n)
+		}
+		if r := db.Check(); !r.OK() {
+			t.Errorf("一致性检查: %v", r.Problems)
+		}
+		if s := db.CacheStats(); s.Pages > 4 {
+			t.Errorf("缓存了 %d 页，超过容量", s.Pages)
+		}
+	})
+
+	t.Run("读取错误", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openPagerKV(t, path, 4)
+		defer db.Close()
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			db.Set([]byte(key), []byte(key))
+		}
+		// 截断文件之后，不在缓存中的页读取失败，返回错误而不是 panic
+		if err := os.Truncate(path, int64(3*db.PageSize)); err != nil {
+			t.Fatal(err)
+		}
+		failed := false
+		for i := 0; i < 2000; i++ {
+			if _, _, err := db.Get([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			t.Error("读取被截断的页应返回错误")
+		}
+		if err := db.Set([]byte("key0000"), []byte("new")); err == nil {
+			t.Error("写入时读取被截断的页应返回错误")
+		}
+		if n := pagerPins(db.pager); n != 0 {
+			t.Errorf("出错之后还有 %d 个 pin", n)
+		}
+	})
+
+	t.Run("校验失败", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		ptr := writeChecksumDB(t, path, "key0500")
+		flipBit(t, path, ptr)
+
+		db := openPagerKV(t, path, 8)
+		defer db.Close()
+		if err := db.Set([]byte("key0500"), []byte("new")); !errors.Is(err, ErrChecksum) {
+			t.Errorf("期望 ErrChecksum, 得到 %v", err)
+		}
+		if val, found, _ := db.Get([]byte("key0000")); !found || len(val) != 50 {
+			t.Error("其他页中的键应能正常读取")
+		}
+	})
+
+	t.Run("并发的读写", func(t *testing.T) {
+		db := openPagerKV(t, filepath.Join(t.TempDir(), "test.db"), 8)
+		defer db.Close()
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte(key))
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := fmt.Sprintf("w%d-%03d", w, i)
+					if err := db.Set([]byte(key), []byte(key)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := fmt.Sprintf("key%03d", i)
+					if val, ok, _ := db.Get([]byte(key)); !ok || string(val) != key {
+						t.Errorf("键 %q: 得到 %q %v", key, val, ok)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if r := db.Check(); !r.OK() {
+			t.Errorf("一致性检查: %v", r.Problems)
+		}
+	})
+
+	t.Run("WAL 模式", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, WAL: true, CachePages: 8}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		ref := map[string]string{}
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte("v"))
+			ref[key] = "v"
+		}
+		walCrash(db)
+		db = openPagerKV(t, path, 8)
+		defer db.Close()
+		verifyKV(t, db, ref)
+	})
+}
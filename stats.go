@@ -0,0 +1,98 @@
+package main
+
+import "encoding/binary"
+
+// 树的一层的统计
+type LevelStats struct {
+	Pages int     // 节点数
+	Keys  int     // 键的数量，叶节点层包括哨兵
+	Bytes int     // 节点实际使用的字节数之和
+	Fill  float64 // 平均填充率，Bytes 除以节点的容量之和
+}
+
+// 树的形状和文件空间的统计
+type Stats struct {
+	Height        int          // 树的高度，空树为 0
+	LeafPages     int          // 叶节点数
+	InternalPages int          // 内部节点数
+	OverflowPages int          // 溢出页数
+	Keys          int          // 键的数量，不含哨兵
+	Levels        []LevelStats // 每一层的统计，Levels[0] 是根节点
+	FreePages     int          // 空闲链表中的页数
+	Pages         uint64       // 已使用的页数，包括元数据页
+	FileSize      int64        // 文件大小，可以大于已使用的页
+	// 碎片率，已使用的页中空闲页所占的比例。
+	// 这些页只能被之后的更新重用，不会归还给文件系统
+	Fragmentation float64
+}
+
+// 从根节点开始遍历整棵树，统计树的形状和空间的使用情况
+// 大量删除之后节点的填充率可能远低于 1/2，shouldMerge 只合并小于 1/4 页的节点。
+// 遍历的是只读事务的快照，不阻塞写事务；空闲页数和文件大小在遍历之后从最新的提交读取
+func (db *KV) Stats() (*Stats, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Abort()
+	s := &Stats{}
+	if tx.tree.root != 0 {
+		if err := treeStats(&tx.tree, s, tx.tree.root, 0); err != nil {
+			return nil, err
+		}
+		s.Keys-- // 哨兵
+	}
+	s.Height = len(s.Levels)
+	capacity := float64(tx.tree.nodeSize())
+	for i := range s.Levels {
+		l := &s.Levels[i]
+		l.Fill = float64(l.Bytes) / (float64(l.Pages) * capacity)
+	}
+	// 空闲链表只由写入者修改
+	db.writer.Lock()
+	s.FreePages = db.free.Total()
+	s.Pages = db.page.flushed
+	s.FileSize = int64(db.mmap.file)
+	db.writer.Unlock()
+	if s.Pages > 1 {
+		s.Fragmentation = float64(s.FreePages) / float64(s.Pages-1)
+	}
+	return s, nil
+}
+
+// 统计以 ptr 为根、位于第 depth 层的子树
+func treeStats(tree *BTree, s *Stats, ptr uint64, depth int) error {
+	node, err := treeLoad(tree, ptr)
+	if err != nil {
+		return err
+	}
+	defer treeUnpin(tree, ptr)
+	if depth == len(s.Levels) {
+		s.Levels = append(s.Levels, LevelStats{})
+	}
+	l := &s.Levels[depth]
+	l.Pages++
+	l.Keys += int(node.nkeys())
+	l.Bytes += int(node.nbytes())
+
+	if node.btype() == BNODE_NODE {
+		s.InternalPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := treeStats(tree, s, node.getPtr(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	s.LeafPages++
+	s.Keys += int(node.nkeys())
+	capacity := uint64(overflowCap(tree.pageSize()))
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.isOverflow(i) {
+			// 溢出页的数量由值的大小决定，不需要读取溢出页
+			total := binary.LittleEndian.Uint64(node.getVal(i)[0:8])
+			s.OverflowPages += int((total + capacity - 1) / capacity)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("空数据库", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		s, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Height != 0 || s.Keys != 0 || len(s.Levels) != 0 || s.LeafPages != 0 {
+			t.Errorf("空数据库: %+v", s)
+		}
+	})
+
+	t.Run("与检查的结果一致", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		for i := 0; i < 3000; i++ {
+			val := strings.Repeat("v", i%100)
+			if i%500 == 0 {
+				val = strings.Repeat("o", 3*BTREE_PAGE_SIZE)
+			}
+			db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(val))
+		}
+		s, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := db.Check()
+		if s.Keys != 3000 || s.Keys != r.Keys || s.Height != r.Height || s.Pages != r.Pages ||
+			s.LeafPages+s.InternalPages != r.TreePages || s.OverflowPages != r.OverflowPages || s.FreePages != r.FreePages {
+			t.Errorf("统计 %+v 与检查 %+v 不一致", s, r)
+		}
+		if len(s.Levels) != s.Height || s.Levels[0].Pages != 1 || s.Levels[s.Height-1].Pages != s.LeafPages {
+			t.Errorf("每层的统计错误: %+v", s.Levels)
+		}
+		if s.Levels[s.Height-1].Keys != s.Keys+1 {
+			t.Errorf("叶节点层的键数 %d，应为 %d", s.Levels[s.Height-1].Keys, s.Keys+1)
+		}
+		if s.FileSize < int64(s.Pages)*int64(db.PageSize) {
+			t.Errorf("文件大小 %d 小于 %d 页", s.FileSize, s.Pages)
+		}
+	})
+
+	t.Run("大量删除之后填充率下降", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		for i := 0; i < 5000; i++ {
+			db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 50)))
+		}
+		before, _ := db.Stats()
+		// 顺序插入的叶节点约半满，删除 40% 之后仍大于 1/4，不会触发合并
+		for i := 0; i < 5000; i++ {
+			if i%5 >= 3 {
+				db.Del([]byte(fmt.Sprintf("key%05d", i)))
+			}
+		}
+		after, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		leafBefore := before.Levels[before.Height-1].Fill
+		leafAfter := after.Levels[after.Height-1].Fill
+		if leafBefore < 0.45 || leafAfter > leafBefore*0.7 {
+			t.Errorf("叶节点的填充率: 删除之前 %.2f，之后 %.2f", leafBefore, leafAfter)
+		}
+		if after.Keys != 3000 || after.Fragmentation <= 0 || after.Fragmentation >= 1 {
+			t.Errorf("删除之后的统计: %+v", after)
+		}
+	})
+	t.Run("与写事务并发", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				if err := db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(strings.Repeat("v", 50))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		// 键只增不减，每次统计的是某一次提交的快照
+		prev := 0
+		for i := 0; i < 50; i++ {
+			s, err := db.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Keys < prev || s.Keys > 2000 {
+				t.Fatalf("键的数量 %d, 之前 %d", s.Keys, prev)
+			}
+			prev = s.Keys
+		}
+		wg.Wait()
+		if s, _ := db.Stats(); s.Keys != 2000 {
+			t.Errorf("键的数量 %d, 期望 2000", s.Keys)
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"iter"
+	"sync/atomic"
+)
+
+// 事务
+//
+// 节点从不原地修改，任何一个已提交的根节点都是一致的快照。
+// 只读事务持有开始时最新提交的快照，可以与写入者并发地读取，取得快照时不需要加锁；
+// 在它结束之前，之后的提交释放的页不会被重用。KV 可以被多个 goroutine 同时使用。
+//
+// 读写事务在私有的根节点上执行多次 Set/Del，新页只保存在内存中。
+// Commit 时一次性写入所有新页和元数据页，Abort 时全部丢弃，
+// 因此多个键的更新要么全部生效，要么全部不生效。同一时间只有一个读写事务。
+type Tx struct {
+	db       *KV
+	readonly bool
+	snap     *snapshot // 只读事务使用的快照
+	meta     []byte    // 读写事务开始时的元数据，用于回滚
+	wal      []byte    // WAL 模式下事务中的操作，提交时作为一条记录写入日志
+	tree     BTree
+	iters    []*BIter // 事务中创建的迭代器，结束时关闭
+	done     bool     // 已经结束
+}
+
+// 一次提交之后的状态，提交时整个替换，读事务原子地取得最新的快照
+type snapshot struct {
+	version uint64
+	root    uint64
+	tailSeq uint64       // 空闲链表的尾部序号，之后释放的页对这个快照可见
+	npages  uint64       // 已写入文件的页数，快照中的页号都小于它
+	chunks  [][]byte     // mmap 只会追加新的段，快照中的段一直有效
+	readers atomic.Int64 // 使用这个快照的读事务数
+}
+
+var errTxDone = errors.New("transaction has already been committed or aborted")
+var errTxReadOnly = errors.New("write in a read-only transaction")
+
+// 数据库关闭之后开始事务时返回
+var ErrDBClosed = errors.New("database is closed")
+
+// 只读打开的数据库上开始写事务时返回
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// 开始一个事务，数据库已经关闭时返回错误
+func (db *KV) Begin(readonly bool) (*Tx, error) {
+	if db.fp == nil {
+		return nil, ErrDBClosed
+	}
+	if readonly {
+		return beginRead(db), nil
+	}
+	if db.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	db.writer.Lock()
+	tx := &Tx{db: db}
+	tx.meta = beginUpdate(db)
+	tx.tree = db.tree // 私有的根节点，提交时才写回 db.tree
+	return tx, nil
+}
+
+func beginRead(db *KV) *Tx {
+	tx := &Tx{db: db, readonly: true}
+	for {
+		tx.snap = db.latest.Load()
+		tx.snap.readers.Add(1)
+		if db.latest.Load() == tx.snap {
+			break
+		}
+		// 同时有新的提交，写入者可能已经认为旧的快照没有读事务，重新取得最新的快照
+		tx.snap.readers.Add(-1)
+	}
+	tx.tree.root = tx.snap.root
+	chunks := tx.snap.chunks
+	tx.tree.size = db.PageSize - db.pageHeader()
+	tx.tree.get = func(ptr uint64) []byte {
+		return db.readPage(chunks, ptr)[db.pageHeader():]
+	}
+	npages := tx.snap.npages
+	tx.tree.check = func(ptr uint64) error {
+		if err := checkPagePtr(ptr, npages); err != nil {
+			return err
+		}
+		return db.pageCheck(chunks, ptr)
+	}
+	if db.pager != nil {
+		tx.tree.unpin = db.pager.unpin
+	}
+	return tx
+}
+
+// 提交事务，持久化所有更新
+// 失败时事务中的更新全部丢弃，事务同样结束
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	if tx.readonly {
+		tx.Abort()
+		return nil
+	}
+	tx.done = true
+	tx.closeIters()
+	defer tx.db.writer.Unlock()
+	db := tx.db
+	if db.tree.root == tx.tree.root && len(db.page.updates) == 0 {
+		return nil // 没有任何修改
+	}
+	db.tree.root = tx.tree.root
+	if db.wal.fp != nil {
+		return walCommit(db, tx)
+	}
+	return updateOrRevert(db, tx.meta)
+}
+
+// 结束事务，读写事务丢弃所有未提交的更新
+func (tx *Tx) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.closeIters()
+	if !tx.readonly {
+		revertPages(tx.db, tx.meta)
+		tx.db.writer.Unlock()
+		return
+	}
+	tx.snap.readers.Add(-1)
+}
+
+// 写入一个键值对
+func (tx *Tx) Set(key []byte, val []byte) error {
+	if err := tx.checkWrite(); err != nil {
+		return err
+	}
+	err := tx.afterWrite(tx.tree.Insert(key, val))
+	if err == nil {
+		tx.log(WAL_INSERT, key, val)
+	}
+	return err
+}
+
+// 按 req.Mode 插入或更新一个键值对，结果写回 req
+func (tx *Tx) InsertEx(req *UpdateReq) error {
+	if err := tx.checkWrite(); err != nil {
+		return err
+	}
+	err := tx.afterWrite(tx.tree.InsertEx(req))
+	if err == nil && req.Updated {
+		tx.log(WAL_INSERT, req.Key, req.Val)
+	}
+	return err
+}
+
+// 当前值等于 expected 时写入 newVal，expected 为 nil 表示期望键不存在
+func (tx *Tx) CompareAndSwap(key []byte, expected []byte, newVal []byte) (bool, error) {
+	req := &UpdateReq{Key: key, Val: newVal, Mode: MODE_CAS, Expect: expected}
+	if err := tx.InsertEx(req); err != nil {
+		return false, err
+	}
+	return casMatched(req), nil
+}
+
+// 删除一个键
+func (tx *Tx) Del(key []byte) (bool, error) {
+	if err := tx.checkWrite(); err != nil {
+		return false, err
+	}
+	deleted, err := tx.tree.Delete(key)
+	if err = tx.afterWrite(err); err != nil {
+		return false, err
+	}
+	if deleted {
+		tx.log(WAL_DELETE, key, nil)
+	}
+	return deleted, nil
+}
+
+// 删除一个键，被删除的值写回 req.Old
+func (tx *Tx) DeleteEx(req *DeleteReq) (bool, error) {
+	if err := tx.checkWrite(); err != nil {
+		return false, err
+	}
+	deleted, err := tx.tree.DeleteEx(req)
+	if err = tx.afterWrite(err); err != nil {
+		return false, err
+	}
+	if deleted {
+		tx.log(WAL_DELETE, req.Key, nil)
+	}
+	return deleted, nil
+}
+
+// 删除 [start, end) 范围内的所有键，返回删除的键数
+func (tx *Tx) DeleteRange(start, end []byte) (int, error) {
+	if err := tx.checkWrite(); err != nil {
+		return 0, err
+	}
+	count, err := tx.tree.DeleteRange(start, end)
+	if err = tx.afterWrite(err); err != nil {
+		return 0, err
+	}
+	if count > 0 && end == nil {
+		tx.log(WAL_DELETE_RANGE_FROM, start, nil)
+	} else if count > 0 {
+		tx.log(WAL_DELETE_RANGE, start, end)
+	}
+	return count, nil
+}
+
+// 把严格递增的键值对批量导入空树，返回导入的键数
+func (tx *Tx) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	if err := tx.checkWrite(); err != nil {
+		return 0, err
+	}
+	if tx.db.wal.fp == nil {
+		count, err := tx.tree.BulkLoad(kvs, fill)
+		if err = tx.afterWrite(err); err != nil {
+			return 0, err
+		}
+		return count, nil
+	}
+	// 导入的键值对作为插入写入日志，导入失败时树没有修改，丢弃这些操作
+	n := len(tx.wal)
+	logged := func(yield func([]byte, []byte) bool) {
+		for key, val := range kvs {
+			tx.log(WAL_INSERT, key, val)
+			if !yield(key, val) {
+				return
+			}
+		}
+	}
+	count, err := tx.tree.BulkLoad(logged, fill)
+	if err = tx.afterWrite(err); err != nil {
+		tx.wal = tx.wal[:n]
+		return 0, err
+	}
+	return count, nil
+}
+
+// WAL 模式下记录事务中的一个操作
+func (tx *Tx) log(op byte, key []byte, val []byte) {
+	if tx.db.wal.fp != nil {
+		tx.wal = walAppendOp(tx.wal, op, key, val)
+	}
+}
+
+// 树的操作结束之后检查错误
+// 页损坏时树可能已被部分修改，空闲链表出错时链表可能不完整，都只能回滚整个事务
+func (tx *Tx) afterWrite(err error) error {
+	if ferr := tx.db.free.err; ferr != nil {
+		tx.Abort()
+		return ferr
+	}
+	if errors.Is(err, ErrCorruptPage) {
+		tx.Abort()
+	}
+	return err
+}
+
+func (tx *Tx) checkWrite() error {
+	if tx.done {
+		return errTxDone
+	}
+	if tx.readonly {
+		return errTxReadOnly
+	}
+	return nil
+}
+
+// 读取一个键，页损坏时返回错误
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	return tx.tree.Get(key)
+}
+
+// 定位到小于等于 key 的最大键，迭代器在事务结束时关闭
+func (tx *Tx) SeekLE(key []byte) *BIter {
+	iter := tx.tree.SeekLE(key)
+	tx.iters = append(tx.iters, iter)
+	return iter
+}
+
+// 定位到大于等于 key 的最小键，迭代器在事务结束时关闭
+func (tx *Tx) SeekGE(key []byte) *BIter {
+	iter := tx.tree.SeekGE(key)
+	tx.iters = append(tx.iters, iter)
+	return iter
+}
+
+// 释放迭代器 pin 住的页，读写事务要在更新的页写入文件或者丢弃之前释放
+func (tx *Tx) closeIters() {
+	for _, iter := range tx.iters {
+		iter.Close()
+	}
+	tx.iters = nil
+}
+
+// 按顺序遍历 [start, end) 范围内的键值对，读到损坏的页时提前结束
+func (tx *Tx) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return tx.tree.Range(start, end)
+}
+
+// 与 Range 相同，另外返回取得读取页的错误的函数，见 BTree.RangeErr
+func (tx *Tx) RangeErr(start, end []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return tx.tree.RangeErr(start, end)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTxReadOnly(t *testing.T) {
+	t.Run("快照隔离", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		for i := 0; i < 300; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if i%2 == 0 {
+				_, err = db.Del(key)
+			} else {
+				err = db.Set(key, []byte("v2"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Set([]byte("key999"), []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		seq, errf := tx.RangeErr(nil, nil)
+		for k, v := range seq {
+			if string(v) != "v1" {
+				t.Errorf("快照中键 %q 的值错误: 得到 %q", k, v)
+			}
+			n++
+		}
+		if n != 300 || errf() != nil {
+			t.Errorf("快照中的键数量错误: 期望 300, 得到 %d: %v", n, errf())
+		}
+		if _, found, _ := tx.Get([]byte("key999")); found {
+			t.Error("快照中不应看到之后插入的键")
+		}
+		tx.Abort()
+
+		tx, _ = db.Begin(true)
+		defer tx.Abort()
+		if _, found, _ := tx.Get([]byte("key000")); found {
+			t.Error("新的快照中应看不到已删除的键")
+		}
+		if val, _, _ := tx.Get([]byte("key001")); string(val) != "v2" {
+			t.Errorf("新的快照中值错误: 得到 %q", val)
+		}
+	})
+
+	t.Run("读事务可见的页不被重用", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		for i := 0; i < 300; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, _ := db.Begin(true)
+		used := db.page.flushed
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 300; i++ {
+				val := []byte(fmt.Sprintf("new%d", round))
+				if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), val); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if db.page.flushed <= used {
+			t.Error("有读事务时旧页不应被重用")
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if val, found, _ := tx.Get([]byte(key)); !found || string(val) != "old" {
+				t.Fatalf("快照被破坏: 键 %q 得到 %q %v", key, val, found)
+			}
+		}
+		tx.Abort()
+		tx.Abort() // 重复结束没有影响
+		if n := tx.snap.readers.Load(); n != 0 {
+			t.Errorf("读事务没有被移除: %d", n)
+		}
+
+		// 读事务结束后，旧页重新可以重用
+		used = db.page.flushed
+		for i := 0; i < 300; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("last")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if db.page.flushed != used {
+			t.Errorf("读事务结束后旧页应被重用: %d 页 -> %d 页", used, db.page.flushed)
+		}
+	})
+
+	t.Run("最老的读事务", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		var txs []*Tx
+		for i := 0; i < 5; i++ {
+			if err := db.Set([]byte("k"), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+			tx, _ := db.Begin(true)
+			txs = append(txs, tx)
+		}
+		txs[0].Abort()
+		txs[3].Abort()
+		// 开始写事务时去掉没有读事务的快照
+		wtx, _ := db.Begin(false)
+		wtx.Abort()
+		if db.snapshots[0] != txs[1].snap {
+			t.Errorf("最老的快照应为最老的读事务的快照: 得到版本 %d", db.snapshots[0].version)
+		}
+		if n := len(db.snapshots); n != 3 {
+			t.Errorf("应只保留读事务 1、2、4 的快照，其中 4 是最新的: 得到 %d 个", n)
+		}
+		for i, tx := range txs {
+			if tx.done {
+				continue
+			}
+			if val, _, _ := tx.Get([]byte("k")); string(val) != strconv.Itoa(i) {
+				t.Errorf("读事务 %d 的值错误: 得到 %q", i, val)
+			}
+			tx.Abort()
+		}
+	})
+
+}
+
+func TestTxReadWrite(t *testing.T) {
+	t.Run("批量提交", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		if err := db.Set([]byte("key000"), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		version := db.latest.Load().version
+
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, _ := db.Begin(true)
+		for i := 0; i < 500; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := tx.Del([]byte("key499")); err != nil {
+			t.Fatal(err)
+		}
+		// 事务内可以读到自己的修改，其他读事务看不到
+		if val, _, _ := tx.Get([]byte("key100")); string(val) != "new" {
+			t.Errorf("事务内读取错误: 得到 %q", val)
+		}
+		if _, found, _ := reader.Get([]byte("key100")); found {
+			t.Error("未提交的修改对读事务可见")
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if db.latest.Load().version != version+1 {
+			t.Errorf("一次提交应只产生一个版本: %d -> %d", version, db.latest.Load().version)
+		}
+		if val, _, _ := reader.Get([]byte("key000")); string(val) != "old" {
+			t.Errorf("已开始的读事务看到了新的提交: 得到 %q", val)
+		}
+		reader.Abort()
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		for i := 0; i < 500; i++ {
+			val, found, _ := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if i == 499 {
+				if found {
+					t.Error("已删除的键仍然存在")
+				}
+			} else if string(val) != "new" {
+				t.Fatalf("键 key%03d 错误: 得到 %q", i, val)
+			}
+		}
+	})
+
+	t.Run("回滚", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openTestKV(t, path)
+		for i := 0; i < 300; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, used, free := db.tree.root, db.page.flushed, db.free.Total()
+
+		tx, _ := db.Begin(false)
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := tx.Set(key, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Del(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx.Abort()
+		if err := tx.Commit(); err == nil {
+			t.Error("回滚后提交应失败")
+		}
+		if err := tx.Set([]byte("k"), []byte("v")); err == nil {
+			t.Error("回滚后写入应失败")
+		}
+		if db.tree.root != root || db.page.flushed != used || db.free.Total() != free {
+			t.Error("回滚后状态没有恢复")
+		}
+		if len(db.page.updates) != 0 {
+			t.Errorf("回滚后仍有 %d 个未写入的页", len(db.page.updates))
+		}
+		// 回滚后可以开始新的写事务
+		if err := db.Set([]byte("key999"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		for i := 0; i < 300; i++ {
+			if val, _, _ := db.Get([]byte(fmt.Sprintf("key%03d", i))); string(val) != "old" {
+				t.Fatalf("回滚的修改被持久化: key%03d 得到 %q", i, val)
+			}
+		}
+	})
+
+	t.Run("校验失败后事务仍可用", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		tx, _ := db.Begin(false)
+		if err := tx.Set([]byte("k1"), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Set(nil, []byte("v")); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("期望 ErrEmptyKey, 得到 %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if val, _, _ := db.Get([]byte("k1")); string(val) != "v1" {
+			t.Errorf("提交后值错误: 得到 %q", val)
+		}
+		if err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("期望 ErrKeyTooLarge, 得到 %v", err)
+		}
+	})
+
+	t.Run("没有修改时不提交", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		if err := db.Set([]byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		version := db.latest.Load().version
+		for _, req := range []*UpdateReq{
+			{Key: []byte("k"), Val: []byte("v")},
+			{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_INSERT_ONLY},
+			{Key: []byte("x"), Val: []byte("v"), Mode: MODE_UPDATE_ONLY},
+		} {
+			if err := db.InsertEx(req); err != nil || req.Updated {
+				t.Errorf("不应修改: %v %v", err, req.Updated)
+			}
+		}
+		if db.latest.Load().version != version {
+			t.Error("没有修改时不应提交新的版本")
+		}
+		req := &UpdateReq{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_UPDATE_ONLY}
+		if err := db.InsertEx(req); err != nil || !req.Updated || string(req.Old) != "v" {
+			t.Errorf("更新错误: %v %v %q", err, req.Updated, req.Old)
+		}
+		if db.latest.Load().version != version+1 {
+			t.Error("修改后应提交新的版本")
+		}
+	})
+
+	t.Run("比较并交换", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		if ok, err := db.CompareAndSwap([]byte("leader"), nil, []byte("a")); err != nil || !ok {
+			t.Fatalf("不存在时创建失败: %v %v", ok, err)
+		}
+		if ok, _ := db.CompareAndSwap([]byte("leader"), nil, []byte("b")); ok {
+			t.Error("键已存在时创建应失败")
+		}
+		version := db.latest.Load().version
+		if ok, _ := db.CompareAndSwap([]byte("leader"), []byte("b"), []byte("c")); ok {
+			t.Error("当前值不等时交换应失败")
+		}
+		if db.latest.Load().version != version {
+			t.Error("比较失败时不应提交新的版本")
+		}
+		if ok, _ := db.CompareAndSwap([]byte("leader"), []byte("a"), []byte("b")); !ok {
+			t.Error("当前值相等时交换应成功")
+		}
+		if val, _, _ := db.Get([]byte("leader")); string(val) != "b" {
+			t.Errorf("交换后的值错误: 得到 %q", val)
+		}
+
+		tx, _ := db.Begin(true)
+		defer tx.Abort()
+		if _, err := tx.CompareAndSwap([]byte("leader"), nil, []byte("x")); err == nil {
+			t.Error("只读事务中比较并交换应失败")
+		}
+	})
+
+	t.Run("只读事务不能写入", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		defer db.Close()
+		tx, _ := db.Begin(true)
+		defer tx.Abort()
+		if err := tx.Set([]byte("k"), []byte("v")); err == nil {
+			t.Error("只读事务写入应失败")
+		}
+		if _, err := tx.Del([]byte("k")); err == nil {
+			t.Error("只读事务删除应失败")
+		}
+	})
+
+	t.Run("关闭之后", func(t *testing.T) {
+		db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+		db.Set([]byte("key"), []byte("val"))
+		db.Close()
+		for _, readonly := range []bool{true, false} {
+			if _, err := db.Begin(readonly); !errors.Is(err, ErrDBClosed) {
+				t.Errorf("期望 ErrDBClosed, 得到 %v", err)
+			}
+		}
+		if _, _, err := db.Get([]byte("key")); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("期望 ErrDBClosed, 得到 %v", err)
+		}
+		if err := db.Set([]byte("key"), []byte("new")); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("期望 ErrDBClosed, 得到 %v", err)
+		}
+	})
+}
+
+func TestTxConcurrent(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	const nkeys = 200
+	for i := 0; i < nkeys; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 写入者按键的顺序逐轮更新，任何快照中的值都应是非递增的
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		for round := 1; round <= 10; round++ {
+			for i := 0; i < nkeys; i++ {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				if err := db.Set(key, []byte(strconv.Itoa(round))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tx, err := db.Begin(true)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, prev := 0, 1<<30
+				seq, errf := tx.RangeErr(nil, nil)
+				for k, v := range seq {
+					cur, err := strconv.Atoi(string(v))
+					if err != nil || cur > prev {
+						t.Errorf("快照不一致: 键 %q 的值 %q 在 %d 之后", k, v, prev)
+					}
+					prev = cur
+					n++
+				}
+				if n != nkeys || errf() != nil {
+					t.Errorf("快照中的键数量错误: 得到 %d: %v", n, errf())
+				}
+				tx.Abort()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 多个写入者通过组提交并发地写入，同时有读事务扫描和读取
+// 用 go test -race 运行，检查没有数据竞争
+func TestTxConcurrentWriters(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	const writers, n = 4, 200
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	// 每个事务同时写入 a/ 和 b/ 下的一个键，任何快照中两者的数量都相同
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				suffix := fmt.Sprintf("%d-%03d", w, i)
+				err := db.Update(func(tx *Tx) error {
+					if err := tx.Set([]byte("a/"+suffix), []byte(suffix)); err != nil {
+						return err
+					}
+					return tx.Set([]byte("b/"+suffix), []byte(suffix))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !stop.Load() {
+				tx, _ := db.Begin(true)
+				na, nb := 0, 0
+				var last []byte
+				seq, errf := tx.RangeErr([]byte("a/"), []byte("c/"))
+				for k, v := range seq {
+					last = append(last[:0], k...)
+					if string(k[2:]) != string(v) {
+						t.Errorf("键 %q 的值 %q", k, v)
+					}
+					if k[0] == 'a' {
+						na++
+					} else {
+						nb++
+					}
+				}
+				if na != nb || errf() != nil {
+					t.Errorf("快照不一致: %d 个 a, %d 个 b: %v", na, nb, errf())
+				}
+				tx.Abort()
+				// 键只增不减，之后开始的读取不会看到更旧的版本
+				if _, ok, _ := db.Get(last); last != nil && !ok {
+					t.Errorf("之后的读取中缺少键 %q", last)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stop.Store(true)
+	readers.Wait()
+	if r := db.Check(); !r.OK() || r.Keys != 2*writers*n {
+		t.Errorf("检查: %d 个键, %v", r.Keys, r.Problems)
+	}
+}
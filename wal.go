@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// 预写日志（WAL）
+//
+// 写时复制的每次提交都要 fsync 整条根到叶的路径和元数据页。
+// WAL 模式下提交时把事务的逻辑操作作为一条记录追加到日志并 fsync，
+// 新页仍通过 pwrite 写入数据文件，读事务照常通过 mmap（或页缓存）读取，但数据文件不 fsync，元数据页也不更新。
+// 日志超过 CheckpointSize 或关闭数据库时做检查点：fsync 数据文件、写入元数据页，然后清空日志。
+//
+// 崩溃之后，磁盘上的元数据页指向上一次检查点的树，打开时在它的基础上重放日志。
+// 为了保证这棵树完整，检查点之后释放的页在下一次检查点之前不会重用，见 beginUpdate。
+// 记录中的操作都是幂等的（插入的是最终的值），写入元数据页之后、清空日志之前崩溃时重复重放也没有问题。
+//
+// 日志文件是数据库文件加上 WAL_SUFFIX，每条记录是一个事务：
+// | crc32c | size | ops |
+// |   4B   |  4B  | ... |
+// crc32c 覆盖 size 和 ops，校验失败的记录及其之后的内容是崩溃时没有写完的，重放时丢弃。
+// 每个操作：
+// | type | klen | vlen | key | val |
+// |  1B  |  4B  |  4B  | ... | ... |
+const WAL_SUFFIX = "-wal"
+
+// 日志超过这个大小时做检查点
+const WAL_CHECKPOINT_SIZE = 4 << 20
+
+// 日志中的操作类型，WAL_DELETE_RANGE 的 key 和 val 是范围的 start 和 end
+// 没有上界的范围记为 WAL_DELETE_RANGE_FROM，只有 start，空的 val 不能表示 nil
+const (
+	WAL_INSERT            = 1
+	WAL_DELETE            = 2
+	WAL_DELETE_RANGE      = 3
+	WAL_DELETE_RANGE_FROM = 4
+)
+
+const WAL_RECORD_HEADER = 8
+const WAL_OP_HEADER = 9
+
+// 在 ops 后面追加一个操作
+func walAppendOp(ops []byte, op byte, key []byte, val []byte) []byte {
+	var hdr [WAL_OP_HEADER]byte
+	hdr[0] = op
+	binary.LittleEndian.PutUint32(hdr[1:5], uint32(len(key)))
+	binary.LittleEndian.PutUint32(hdr[5:9], uint32(len(val)))
+	ops = append(ops, hdr[:]...)
+	ops = append(ops, key...)
+	return append(ops, val...)
+}
+
+// 把一个事务的操作编码为一条日志记录
+func walRecord(ops []byte) []byte {
+	rec := make([]byte, WAL_RECORD_HEADER+len(ops))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(ops)))
+	copy(rec[WAL_RECORD_HEADER:], ops)
+	binary.LittleEndian.PutUint32(rec[0:4], crc32.Checksum(rec[4:], crc32c))
+	return rec
+}
+
+// 解析日志，返回完整的记录中的操作，遇到不完整或校验失败的记录时停止
+func walParse(data []byte) [][]byte {
+	var records [][]byte
+	for len(data) >= WAL_RECORD_HEADER {
+		size := uint64(binary.LittleEndian.Uint32(data[4:8]))
+		if uint64(len(data)) < WAL_RECORD_HEADER+size {
+			break
+		}
+		rec := data[:WAL_RECORD_HEADER+size]
+		if binary.LittleEndian.Uint32(rec[0:4]) != crc32.Checksum(rec[4:], crc32c) {
+			break
+		}
+		records = append(records, rec[WAL_RECORD_HEADER:])
+		data = data[len(rec):]
+	}
+	return records
+}
+
+// 在事务中执行一条记录中的操作
+func walApply(tx *Tx, ops []byte) error {
+	for len(ops) > 0 {
+		if len(ops) < WAL_OP_HEADER {
+			return errors.New("truncated log operation")
+		}
+		op := ops[0]
+		klen := uint64(binary.LittleEndian.Uint32(ops[1:5]))
+		vlen := uint64(binary.LittleEndian.Uint32(ops[5:9]))
+		if uint64(len(ops)) < WAL_OP_HEADER+klen+vlen {
+			return errors.New("truncated log operation")
+		}
+		key := ops[WAL_OP_HEADER:][:klen]
+		val := ops[WAL_OP_HEADER+klen:][:vlen]
+		ops = ops[WAL_OP_HEADER+klen+vlen:]
+		var err error
+		switch op {
+		case WAL_INSERT:
+			err = tx.Set(key, val)
+		case WAL_DELETE:
+			_, err = tx.Del(key)
+		case WAL_DELETE_RANGE:
+			_, err = tx.DeleteRange(key, val)
+		case WAL_DELETE_RANGE_FROM:
+			_, err = tx.DeleteRange(key, nil)
+		default:
+			err = fmt.Errorf("bad log operation %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重放上一次没有做检查点的日志，然后在 WAL 模式下打开日志，否则删除日志
+// 重放的结果与普通的提交一样写入数据文件，只读打开时不碰日志
+func walOpen(db *KV) error {
+	if db.ReadOnly {
+		return nil
+	}
+	path := db.Path + WAL_SUFFIX
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read log: %w", err)
+	}
+	if records := walParse(data); len(records) > 0 {
+		tx, err := db.Begin(false)
+		if err != nil {
+			return err
+		}
+		for _, ops := range records {
+			if err := walApply(tx, ops); err != nil {
+				tx.Abort()
+				return fmt.Errorf("replay log: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("replay log: %w", err)
+		}
+	}
+	if !db.WAL {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove log: %w", err)
+		}
+		return nil
+	}
+	// 新建的文件先写入元数据页，否则崩溃后文件无法打开
+	if len(db.page.updates) > 0 {
+		if err := updateFile(db); err != nil {
+			return err
+		}
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	db.wal.fp = fp
+	if err := fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	db.wal.size = 0
+	db.wal.tailSeq = db.free.tailSeq
+	return nil
+}
+
+// WAL 模式下提交一次更新：新页写入数据文件但不 fsync，事务的操作追加到日志并 fsync
+// 失败时把内存中的状态回滚到上一次提交
+func walCommit(db *KV, tx *Tx) error {
+	// 上一次提交失败后，日志末尾可能有写了一部分的记录，先截掉它
+	if db.failed {
+		if err := db.wal.fp.Truncate(db.wal.size); err != nil {
+			return fmt.Errorf("truncate log: %w", err)
+		}
+		db.failed = false
+	}
+	err := writePages(db)
+	if err == nil {
+		err = walAppend(db, walRecord(tx.wal))
+	}
+	if err != nil {
+		// 写入的新页不属于上一次提交的树，也不属于上一次检查点的树
+		db.failed = true
+		revertPages(db, tx.meta)
+		return err
+	}
+	publishCommit(db)
+	if db.wal.size >= int64(db.checkpointSize()) {
+		// 检查点失败不影响已经写入日志的提交，日志保留到下一次检查点
+		_ = checkpoint(db)
+	}
+	return nil
+}
+
+// 追加一条记录到日志并 fsync
+func walAppend(db *KV, rec []byte) error {
+	if _, err := db.wal.fp.WriteAt(rec, db.wal.size); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	if err := db.wal.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync log: %w", err)
+	}
+	db.wal.size += int64(len(rec))
+	return nil
+}
+
+func (db *KV) checkpointSize() int {
+	if db.CheckpointSize == 0 {
+		return WAL_CHECKPOINT_SIZE
+	}
+	return db.CheckpointSize
+}
+
+// 做检查点，不是 WAL 模式时什么也不做
+func (db *KV) Checkpoint() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.wal.fp == nil {
+		return nil
+	}
+	return checkpoint(db)
+}
+
+// 数据文件落盘之后写入元数据页，日志中的记录都已体现在树中，可以清空
+// 之后之前释放的页都可以重用
+func checkpoint(db *KV) error {
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := db.wal.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	db.wal.size = 0
+	db.wal.tailSeq = db.free.tailSeq
+	return nil
+}
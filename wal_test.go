@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// 以 WAL 模式打开数据库
+func openWALKV(t *testing.T, path string, checkpointSize int) *KV {
+	t.Helper()
+	db := &KV{Path: path, WAL: true, CheckpointSize: checkpointSize}
+	if err := db.Open(); err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	return db
+}
+
+// 模拟崩溃：不做检查点直接关闭，数据文件中没有 fsync 的页不受影响，
+// 但元数据页仍是上一次检查点的
+func walCrash(db *KV) {
+	db.wal.size = 0
+	db.Close()
+}
+
+// 检查数据库的内容与 ref 一致，并且通过一致性检查
+func verifyKV(t *testing.T, db *KV, ref map[string]string) {
+	t.Helper()
+	n := 0
+	seq, errf := db.tree.RangeErr(nil, nil)
+	for k, v := range seq {
+		if want, ok := ref[string(k)]; !ok || want != string(v) {
+			t.Errorf("键 %q: 得到 %q, 期望 %q (%v)", k, v, want, ok)
+		}
+		n++
+	}
+	if n != len(ref) || errf() != nil {
+		t.Errorf("键的数量 %d, 期望 %d: %v", n, len(ref), errf())
+	}
+	if r := db.Check(); !r.OK() {
+		t.Errorf("一致性检查: %v", r.Problems)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	t.Run("关闭时做检查点", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		ref := map[string]string{}
+		for i := 0; i < 500; i++ {
+			key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i)
+			db.Set([]byte(key), []byte(val))
+			ref[key] = val
+		}
+		if db.wal.size == 0 {
+			t.Error("提交应写入日志")
+		}
+		db.Close()
+		if fi, err := os.Stat(path + WAL_SUFFIX); err != nil || fi.Size() != 0 {
+			t.Errorf("检查点之后日志应为空: %v", err)
+		}
+		// 不使用 WAL 打开时删除日志
+		db = openTestKV(t, path)
+		defer db.Close()
+		verifyKV(t, db, ref)
+		if _, err := os.Stat(path + WAL_SUFFIX); !os.IsNotExist(err) {
+			t.Errorf("日志应被删除: %v", err)
+		}
+	})
+
+	t.Run("崩溃后重放日志", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		ref := map[string]string{}
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte("v1"))
+			ref[key] = "v1"
+		}
+		db.Checkpoint()
+		// 检查点之后的更新只在日志中，释放的页不能被重用
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			switch i % 3 {
+			case 0:
+				db.Del([]byte(key))
+				delete(ref, key)
+			case 1:
+				db.Set([]byte(key), []byte("v2"))
+				ref[key] = "v2"
+			}
+		}
+		db.DeleteRange([]byte("key100"), []byte("key200"))
+		for k := range ref {
+			if k >= "key100" && k < "key200" {
+				delete(ref, k)
+			}
+		}
+		db.CompareAndSwap([]byte("key002"), []byte("v1"), []byte("v3"))
+		ref["key002"] = "v3"
+		walCrash(db)
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("重放没有上界的范围删除", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("k%04d", i)
+			db.Set([]byte(key), []byte("v"))
+		}
+		db.Checkpoint()
+		if n, err := db.DeleteRange([]byte("k0005"), nil); n != 5 || err != nil {
+			t.Fatalf("删除了 %d 个键: %v", n, err)
+		}
+		walCrash(db)
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		ref := map[string]string{}
+		for i := 0; i < 5; i++ {
+			ref[fmt.Sprintf("k%04d", i)] = "v"
+		}
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("日志末尾不完整", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		db.Set([]byte("k1"), []byte("v1"))
+		db.Set([]byte("k2"), []byte("v2"))
+		size := db.wal.size
+		tx, _ := db.Begin(false)
+		tx.Set([]byte("k3"), []byte("v3"))
+		tx.Del([]byte("k1"))
+		tx.Commit()
+		walCrash(db)
+		// 最后一条记录只写了一部分
+		if err := os.Truncate(path+WAL_SUFFIX, size+10); err != nil {
+			t.Fatal(err)
+		}
+
+		db = openWALKV(t, path, 0)
+		verifyKV(t, db, map[string]string{"k1": "v1", "k2": "v2"})
+		// 之后的提交正常进行
+		db.Set([]byte("k4"), []byte("v4"))
+		walCrash(db)
+		db = openWALKV(t, path, 0)
+		defer db.Close()
+		verifyKV(t, db, map[string]string{"k1": "v1", "k2": "v2", "k4": "v4"})
+	})
+
+	t.Run("检查点中途崩溃", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		ref := map[string]string{}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			db.Set([]byte(key), []byte("v"))
+			ref[key] = "v"
+		}
+		db.DeleteRange([]byte("key000"), []byte("key100"))
+		for i := 0; i < 100; i++ {
+			delete(ref, fmt.Sprintf("key%03d", i))
+		}
+		// 元数据页已经写入，但日志还没有清空，重放应当是幂等的
+		db.fp.Sync()
+		masterStore(db)
+		db.fp.Sync()
+		walCrash(db)
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("检查点之后重用空闲页", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 2<<10)
+		defer db.Close()
+		ref := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%02d", i%50)
+			val := fmt.Sprintf("val%d", i)
+			db.Set([]byte(key), []byte(val))
+			ref[key] = val
+		}
+		if db.wal.size >= 2<<10 {
+			t.Errorf("日志大小 %d 超过检查点的阈值", db.wal.size)
+		}
+		// 两次检查点之间大约 70 次提交，每次提交释放一页
+		if db.page.flushed > 200 {
+			t.Errorf("空闲页没有被重用: %d 页", db.page.flushed)
+		}
+		verifyKV(t, db, ref)
+	})
+
+	t.Run("批量导入", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := openWALKV(t, path, 0)
+		ref := map[string]string{}
+		var keys [][]byte
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			keys = append(keys, []byte(key))
+			ref[key] = key
+		}
+		kvs := func(yield func([]byte, []byte) bool) {
+			for _, k := range keys {
+				if !yield(k, k) {
+					return
+				}
+			}
+		}
+		if _, err := db.BulkLoad(kvs, 1); err != nil {
+			t.Fatal(err)
+		}
+		// 导入失败时不记录日志
+		tx, _ := db.Begin(false)
+		n := len(tx.wal)
+		if _, err := tx.BulkLoad(kvs, 1); err == nil {
+			t.Error("非空的树不能导入")
+		}
+		if len(tx.wal) != n {
+			t.Error("失败的导入不应写入日志")
+		}
+		tx.Abort()
+		walCrash(db)
+
+		db = openTestKV(t, path)
+		defer db.Close()
+		verifyKV(t, db, ref)
+	})
+}
+
+func TestWALRecord(t *testing.T) {
+	var ops1, ops2 []byte
+	ops1 = walAppendOp(ops1, WAL_INSERT, []byte("k"), []byte("v"))
+	ops1 = walAppendOp(ops1, WAL_DELETE, []byte("k"), nil)
+	ops2 = walAppendOp(ops2, WAL_DELETE_RANGE, []byte("a"), []byte("z"))
+	data := slices.Concat(walRecord(ops1), walRecord(ops2))
+	if got := walParse(data); len(got) != 2 || !bytes.Equal(got[0], ops1) || !bytes.Equal(got[1], ops2) {
+		t.Errorf("解析错误: %q", got)
+	}
+	for n := 0; n < len(data); n++ {
+		want := 0
+		if n >= len(walRecord(ops1)) {
+			want = 1
+		}
+		if got := walParse(data[:n]); len(got) != want {
+			t.Errorf("截断为 %d 字节: 得到 %d 条记录", n, len(got))
+		}
+	}
+	data[len(data)-1] ^= 1
+	if got := walParse(data); len(got) != 1 {
+		t.Errorf("校验失败的记录应丢弃: 得到 %d 条记录", len(got))
+	}
+}